@@ -0,0 +1,38 @@
+package hashstore
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// A DigestEncoding turns the raw SHA256 of a text into the hash string that
+// clients see and that we store it under. Pattern matches exactly the strings
+// Encode can produce, and is used to validate the {hash} route variable.
+type DigestEncoding struct {
+	Encode  func([]byte) string
+	Pattern string
+}
+
+// DigestEncodings are the encodings HASHTEXT_DIGEST_ENCODING can choose from.
+var DigestEncodings = map[string]DigestEncoding{
+	"hex":       {hex.EncodeToString, `[0-9a-f]{64}`},
+	"base64url": {base64.RawURLEncoding.EncodeToString, `[A-Za-z0-9_-]{43}`},
+	"base32":    {base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString, `[A-Z2-7]{52}`},
+}
+
+// ParseDigestEncoding looks up the encoding called name.
+func ParseDigestEncoding(name string) (DigestEncoding, error) {
+	de, ok := DigestEncodings[name]
+	if !ok {
+		var names []string
+		for n := range DigestEncodings {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return DigestEncoding{}, fmt.Errorf("unknown digest encoding %q, expected one of %v", name, names)
+	}
+	return de, nil
+}
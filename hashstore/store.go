@@ -0,0 +1,91 @@
+package hashstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrHashCollision is returned by StoreText when the hash is already stored
+// for some other text. This can't realistically happen with a full SHA256
+// hash, but we'd rather report it than silently keep the wrong text.
+var ErrHashCollision = errors.New("a different text is already stored with this hash")
+
+// QuotaError is returned by StoreText when storing a new text would take the
+// user over their byte quota.
+type QuotaError struct {
+	Stored, Quota int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("the text would go over the quota of %d bytes, with %d already stored", e.Quota, e.Stored)
+}
+
+// A Querier is a *sql.DB or a *sql.Tx, so that the same queries can run on
+// their own or as part of a transaction.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// StoreText stores the text if it isn't already stored and records the
+// submission, using tables to name the tables. It returns true if this call
+// stored the text. A newly stored text counts against the submitting user's
+// stored bytes, and if that would take them over quota it returns a
+// *QuotaError instead. quota is ignored if it's zero or less. With a quota q
+// must be a transaction, which the caller rolls back on any error, as that's
+// what undoes the insert.
+func StoreText(ctx context.Context, q Querier, tables *strings.Replacer, text, hash, userID string, quota int64) (bool, error) {
+	// When several requests race to store the same new text, Postgres makes
+	// the losers wait for the winner and then skip the insert. Only the
+	// winner gets a row back, so exactly one of them sees the text as novel.
+	//
+	// Concurrent submissions by the same user queue up on the user's row
+	// in the update, and each one checks the quota against the stored bytes
+	// the one before it left, so together they can't go over it.
+	var returned string
+	var counted bool
+	var stored int64
+	err := q.QueryRowContext(
+		ctx,
+		tables.Replace(`WITH inserted AS (
+		     INSERT INTO {hash_text} (hash, text, created_by) VALUES ($1, $2, $3)
+		     ON CONFLICT (hash) DO NOTHING
+		     RETURNING hash, octet_length(text) AS bytes
+		 ), counted AS (
+		     UPDATE {user} SET stored_bytes = stored_bytes + inserted.bytes
+		       FROM inserted
+		      WHERE user_id = $3 AND ($4::bigint <= 0 OR stored_bytes + inserted.bytes <= $4::bigint)
+		     RETURNING user_id
+		 )
+		 SELECT hash, EXISTS (SELECT 1 FROM counted), (SELECT stored_bytes FROM {user} WHERE user_id = $3)
+		   FROM inserted`),
+		hash, text, userID, quota,
+	).Scan(&returned, &counted, &stored)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("could not insert the text with hash = %s: %w", hash, err)
+	}
+	if returned != "" && !counted {
+		return false, &QuotaError{Stored: stored, Quota: quota}
+	}
+
+	novel := returned != ""
+	if !novel {
+		var stored string
+		err := q.QueryRowContext(ctx, tables.Replace(`SELECT text FROM {hash_text} WHERE hash = $1`), hash).Scan(&stored)
+		if err != nil {
+			return false, fmt.Errorf("could not look up the text with hash = %s: %w", hash, err)
+		}
+		if stored != text {
+			return false, ErrHashCollision
+		}
+	}
+
+	_, err = q.ExecContext(ctx, tables.Replace(`INSERT INTO {submission} (user_id, hash, duplicate) VALUES ($1, $2, $3)`), userID, hash, !novel)
+	if err != nil {
+		return false, fmt.Errorf("could not record the submission of hash = %s: %w", hash, err)
+	}
+	return novel, nil
+}
@@ -0,0 +1,84 @@
+// Package hashstore is the storage layer shared by the hashtext server and the
+// tools that work on its database, so that they agree on what the tables are
+// called, how hashes are written, and how a text is stored.
+package hashstore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// TableNames are the names of our tables. Queries refer to each table by a
+// placeholder like {hash_text}, which the Replacer swaps for the real name, so
+// that a deployment sharing a database with other apps can prefix them.
+type TableNames struct {
+	User       string
+	HashText   string
+	Submission string
+	APIKey     string
+	CreditHold string
+	UserUsage  string
+	AdminAudit string
+}
+
+// tablePrefixPattern only allows prefixes that don't need quoting, so that
+// the names match the unquoted ones in schema.sql.
+var tablePrefixPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// maxIdentifierBytes is the longest identifier Postgres keeps. It silently
+// truncates longer ones, which would make two tables' names collide.
+const maxIdentifierBytes = 63
+
+// CheckSchemaName only allows schema names that don't need quoting, for the
+// same reason as table prefixes. It's also what keeps the name from
+// smuggling anything else into the connection string.
+func CheckSchemaName(name string) error {
+	if !tablePrefixPattern.MatchString(name) {
+		return fmt.Errorf("a schema name may only contain lowercase letters, digits, and underscores, and can't start with a digit: %q", name)
+	}
+	if len(name) > maxIdentifierBytes {
+		return fmt.Errorf("the schema name %q is too long", name)
+	}
+	return nil
+}
+
+// NewTableNames returns the table names with prefix prepended to each.
+func NewTableNames(prefix string) (TableNames, error) {
+	if prefix != "" && !tablePrefixPattern.MatchString(prefix) {
+		return TableNames{}, fmt.Errorf("a table prefix may only contain lowercase letters, digits, and underscores, and can't start with a digit: %q", prefix)
+	}
+	t := TableNames{
+		User:       prefix + "user",
+		HashText:   prefix + "hash_text",
+		Submission: prefix + "submission",
+		APIKey:     prefix + "api_key",
+		CreditHold: prefix + "credit_hold",
+		UserUsage:  prefix + "user_usage",
+		AdminAudit: prefix + "admin_audit",
+	}
+	if len(t.AdminAudit) > maxIdentifierBytes {
+		return TableNames{}, fmt.Errorf("the table prefix %q is too long", prefix)
+	}
+	return t, nil
+}
+
+// Names returns every table name, in the order the tables are declared.
+func (t TableNames) Names() []string {
+	return []string{t.User, t.HashText, t.Submission, t.APIKey, t.CreditHold, t.UserUsage, t.AdminAudit}
+}
+
+// Replacer replaces the table placeholders in a query with the table names.
+func (t TableNames) Replacer() *strings.Replacer {
+	return strings.NewReplacer(
+		"{user}", pq.QuoteIdentifier(t.User),
+		"{hash_text}", pq.QuoteIdentifier(t.HashText),
+		"{submission}", pq.QuoteIdentifier(t.Submission),
+		"{api_key}", pq.QuoteIdentifier(t.APIKey),
+		"{credit_hold}", pq.QuoteIdentifier(t.CreditHold),
+		"{user_usage}", pq.QuoteIdentifier(t.UserUsage),
+		"{admin_audit}", pq.QuoteIdentifier(t.AdminAudit),
+	)
+}
@@ -0,0 +1,32 @@
+package hashstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTableNames(t *testing.T) {
+	for _, prefix := range []string{`ht"; DROP TABLE "user`, "HT_", "1ht_", "ht-", strings.Repeat("a", 60)} {
+		_, err := NewTableNames(prefix)
+		assert.NotNil(t, err, "error with the prefix %q", prefix)
+	}
+
+	prefixed, err := NewTableNames("ht_")
+	assert.Nil(t, err, "no error with a valid prefix")
+	assert.Equal(t,
+		`SELECT 1 FROM "ht_user", "ht_hash_text", "ht_submission", "ht_api_key", "ht_credit_hold", "ht_user_usage", "ht_admin_audit"`,
+		prefixed.Replacer().Replace(`SELECT 1 FROM {user}, {hash_text}, {submission}, {api_key}, {credit_hold}, {user_usage}, {admin_audit}`),
+		"replaced every table placeholder",
+	)
+}
+
+func TestCheckSchemaName(t *testing.T) {
+	for _, name := range []string{"public", "tenant_1", "_t"} {
+		assert.Nil(t, CheckSchemaName(name), "%q is a valid schema name", name)
+	}
+	for _, name := range []string{"", "Tenant", "1tenant", "tenant-1", "t' options='-c x=y", strings.Repeat("t", 64)} {
+		assert.NotNil(t, CheckSchemaName(name), "%q is not a valid schema name", name)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	baseURL string
+	userID  string
+	apiKey  string
+)
+
+// A small client for poking at a running hashtext server. It talks to the
+// server over plain HTTP just like any other client would, so it doubles as a
+// quick end-to-end smoke test.
+func main() {
+	flag.StringVar(&baseURL, "url", envOr("HASHTEXT_URL", "http://localhost:8080"), "the base URL of the hashtext server")
+	flag.StringVar(&userID, "user", os.Getenv("HASHTEXT_USER_ID"), "the user_id to send in the X-HashText-User-ID header")
+	flag.StringVar(&apiKey, "api-key", os.Getenv("HASHTEXT_API_KEY"), "the API key to send in the X-HashText-API-Key header")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "submit" && len(args) == 2:
+		body, err := json.Marshal(map[string]string{"text": args[1]})
+		if err != nil {
+			fmt.Println("** Could not encode the text as JSON: " + err.Error())
+			os.Exit(1)
+		}
+		do("POST", "/text", body)
+	case args[0] == "get" && len(args) == 2:
+		do("GET", "/text/"+args[1], nil)
+	case args[0] == "me" && len(args) == 1:
+		do("GET", "/user/me", nil)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] submit <text> | get <hash> | me\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// do makes the request and prints the response body. It exits with an error
+// if the server doesn't respond with a 2xx status.
+func do(method, path string, body []byte) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(baseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("** Could not make the request: " + err.Error())
+		os.Exit(1)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if userID != "" {
+		req.Header.Set("X-HashText-User-ID", userID)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-HashText-API-Key", apiKey)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Println("** Request failed: " + err.Error())
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Println("** Could not read the response body: " + err.Error())
+		os.Exit(1)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Printf("** %s %s returned %s\n", method, path, resp.Status)
+		if len(respBody) > 0 {
+			fmt.Println(string(respBody))
+		}
+		os.Exit(1)
+	}
+
+	io.Copy(os.Stdout, bytes.NewReader(respBody))
+	fmt.Print("\n")
+}
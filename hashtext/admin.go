@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminUserIDs is the set of user_ids allowed to call the /admin routes. It
+// is loaded from the comma-separated HASHTEXT_ADMIN_USER_IDS environment
+// variable at startup.
+var adminUserIDs = map[string]bool{}
+
+func parseAdminUserIDs(s string) map[string]bool {
+	ids := map[string]bool{}
+	for _, id := range strings.Split(s, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// wrapAdminHandler is like wrapHandler, but it also requires that the user is
+// on the admin allow-list. A known user who isn't an admin gets a 403.
+func wrapAdminHandler(
+	handler func(w http.ResponseWriter, r *http.Request),
+) func(w http.ResponseWriter, r *http.Request) {
+
+	h := func(w http.ResponseWriter, r *http.Request) {
+		if !userIsAdmin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+	return wrapHandler(h)
+}
+
+func userIsAdmin(r *http.Request) bool {
+	return adminUserIDs[requestUserID(r)]
+}
+
+// The counts are pointers so that a stat we failed to compute is sent as null
+// rather than as a misleading zero.
+type statsDocument struct {
+	TotalUsers       *int64  `json:"total_users"`
+	TotalTexts       *int64  `json:"total_texts"`
+	TotalCredit      *credit `json:"total_credit"`
+	TextsLast24Hours *int64  `json:"texts_last_24_hours"`
+	DBBreaker        string  `json:"db_breaker"`
+	ReplicaFallbacks int64   `json:"replica_fallbacks"`
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, statsDocument{
+		TotalUsers:       queryStat[int64](withTables(`SELECT COUNT(*) FROM {user}`)),
+		TotalTexts:       queryStat[int64](withTables(`SELECT COUNT(*) FROM {hash_text}`)),
+		TotalCredit:      queryStat[credit](withTables(`SELECT COALESCE(SUM(credit), 0) FROM {user}`)),
+		TextsLast24Hours: queryStat[int64](withTables(`SELECT COUNT(*) FROM {hash_text} WHERE created_at > now() - interval '24 hours'`)),
+		DBBreaker:        dbBreaker.currentState(),
+		ReplicaFallbacks: replicaFallbacks.get(""),
+	})
+}
+
+func queryStat[T any](query string) *T {
+	var n T
+	err := withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(query).Scan(&n)
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query for stats failed: %v: %s", err, query)
+		return nil
+	}
+	return &n
+}
+
+// maxSubmissionRange is the widest window GET /text will search, so that an
+// audit query can't scan the whole submission table.
+const maxSubmissionRange = 31 * 24 * time.Hour
+
+type submissionDocument struct {
+	Hash      string   `json:"hash"`
+	UserID    string   `json:"user_id"`
+	CreatedAt jsonTime `json:"created_at"`
+}
+
+// submissionListDocument is one page of submissions. NextOffset is the offset
+// of the next page, or null if this is the last one. Truncated is set when
+// maxPageBytes cut the page short of the limit.
+type submissionListDocument struct {
+	Submissions []submissionDocument `json:"submissions"`
+	NextOffset  *int                 `json:"next_offset"`
+	Truncated   bool                 `json:"truncated"`
+}
+
+// adminTextsHandler lists the texts submitted between the from and to query
+// parameters, oldest first. It returns each submission's hash rather than the
+// text itself to keep responses small.
+func adminTextsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		t, err := time.Parse(time.RFC3339, q.Get(p.name))
+		if err != nil {
+			sendErrorMessage(w, fmt.Sprintf("The %s parameter must be an RFC 3339 timestamp", p.name), http.StatusBadRequest)
+			return
+		}
+		*p.dest = t
+	}
+	if to.Before(from) {
+		sendErrorMessage(w, "The from parameter must not be after the to parameter", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxSubmissionRange {
+		sendErrorMessage(w, fmt.Sprintf("The range cannot be wider than %s", maxSubmissionRange), http.StatusBadRequest)
+		return
+	}
+
+	if acceptsNDJSON(r) {
+		streamSubmissions(w, from, to)
+		return
+	}
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	// We fetch one extra row to find out whether there's another page.
+	var rows *sql.Rows
+	err := withReadFallback(func(q *sql.DB) (err error) {
+		rows, err = q.Query(
+			withTables(`SELECT hash, user_id, created_at FROM {submission}
+			  WHERE created_at >= $1 AND created_at <= $2
+			  ORDER BY created_at, hash
+			  LIMIT $3 OFFSET $4`),
+			from, to, limit+1, offset,
+		)
+		return err
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to list submissions failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	ld := submissionListDocument{Submissions: []submissionDocument{}}
+	for rows.Next() {
+		var sd submissionDocument
+		if err := rows.Scan(&sd.Hash, &sd.UserID, &sd.CreatedAt); err != nil {
+			log.Printf("Failed to scan a submission: %v", err)
+			sendStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ld.Submissions = append(ld.Submissions, sd)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list submissions: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	ld.Submissions, ld.NextOffset, ld.Truncated = trimPage(ld.Submissions, limit, offset)
+	sendJSONResponse(w, ld)
+}
+
+// streamSubmissions sends every submission in the range as newline-delimited
+// JSON, flushing after each one, so that neither we nor the client has to hold
+// the whole list in memory. It isn't paginated. Once we've started sending
+// rows there's no way to report an error to the client other than cutting the
+// response short.
+func streamSubmissions(w http.ResponseWriter, from, to time.Time) {
+	var rows *sql.Rows
+	err := withReadFallback(func(q *sql.DB) (err error) {
+		rows, err = q.Query(
+			withTables(`SELECT hash, user_id, created_at FROM {submission}
+			  WHERE created_at >= $1 AND created_at <= $2
+			  ORDER BY created_at, hash`),
+			from, to,
+		)
+		return err
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to list submissions failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for rows.Next() {
+		var sd submissionDocument
+		if err := rows.Scan(&sd.Hash, &sd.UserID, &sd.CreatedAt); err != nil {
+			log.Printf("Failed to scan a submission: %v", err)
+			return
+		}
+		if err := writeNDJSONLine(w, sd); err != nil {
+			log.Printf("Failed to write the response body: %v", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list submissions: %v", err)
+	}
+}
+
+// writeNDJSONLine writes v as one line of newline-delimited JSON, encoded
+// with encodeJSON like every other JSON response, so each line gets the
+// service notice and canonical JSON too.
+func writeNDJSONLine(w io.Writer, v interface{}) error {
+	line, err := encodeJSON(v)
+	if err != nil {
+		return err
+	}
+	// Only canonical JSON ends in a newline already.
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	_, err = w.Write(line)
+	return err
+}
+
+// intParam parses an optional integer query parameter, which must be between
+// min and max. If ok is false it has already sent an error response.
+func intParam(w http.ResponseWriter, r *http.Request, name string, def, min, max int) (n int, ok bool) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		sendErrorMessage(w, fmt.Sprintf("The %s parameter must be an integer from %d to %d", name, min, max), http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// boolParam parses an optional query parameter that is 1 for true or 0 for
+// false, like our environment flags. If ok is false it has already sent an
+// error response.
+func boolParam(w http.ResponseWriter, r *http.Request, name string) (b bool, ok bool) {
+	switch r.URL.Query().Get(name) {
+	case "", "0":
+		return false, true
+	case "1":
+		return true, true
+	}
+	sendErrorMessage(w, fmt.Sprintf("The %s parameter must be 0 or 1", name), http.StatusBadRequest)
+	return false, false
+}
+
+// textMetaDocument describes a stored text without including the text itself.
+// CreatedBy and LastAccessedAt are null for texts stored before we tracked
+// them, and for texts that have never been read, respectively.
+type textMetaDocument struct {
+	Hash           string    `json:"hash"`
+	CreatedBy      *string   `json:"created_by"`
+	CreatedAt      jsonTime  `json:"created_at"`
+	LastAccessedAt *jsonTime `json:"last_accessed_at"`
+	Bytes          int64     `json:"bytes"`
+}
+
+func adminTextMetaHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	md := textMetaDocument{Hash: hash}
+	var createdBy sql.NullString
+	var lastAccessed sql.NullTime
+	err := withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(
+			withTables(`SELECT created_by, created_at, last_accessed_at, octet_length(text) FROM {hash_text} WHERE hash = $1`),
+			hash,
+		).Scan(&createdBy, &md.CreatedAt, &lastAccessed, &md.Bytes)
+	})
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		sendStatus(w, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Query to look up text metadata failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	if createdBy.Valid {
+		md.CreatedBy = &createdBy.String
+	}
+	if lastAccessed.Valid {
+		md.LastAccessedAt = &jsonTime{lastAccessed.Time}
+	}
+	sendJSONResponse(w, md)
+}
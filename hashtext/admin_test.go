@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminStatsHandler(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	req := httptest.NewRequest("GET", "http://example.com/admin/stats", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, body := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for admin user")
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+
+	var sd statsDocument
+	err := json.Unmarshal(body, &sd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	if assert.NotNil(t, sd.TotalUsers, "got total_users") {
+		assert.Equal(t, int64(3), *sd.TotalUsers, "counted all users")
+	}
+	assert.NotNil(t, sd.TotalTexts, "got total_texts")
+	assert.NotNil(t, sd.TotalCredit, "got total_credit")
+	assert.NotNil(t, sd.TextsLast24Hours, "got texts_last_24_hours")
+
+	req = httptest.NewRequest("GET", "http://example.com/admin/stats", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Xiomara"))
+	resp, _ = fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for user who is not an admin")
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	for _, tc := range []struct {
+		userID string
+		status int
+		desc   string
+	}{
+		{"", http.StatusUnauthorized, "returned 401 without a credential"},
+		{"not a user", http.StatusUnauthorized, "returned 401 for an unknown user"},
+		{sha256String("Xiomara"), http.StatusForbidden, "returned 403 for a known user who isn't an admin"},
+		{sha256String("Jane"), http.StatusOK, "returned 200 for an admin"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/admin/stats", nil)
+		if tc.userID != "" {
+			req.Header.Set("X-HashText-User-ID", tc.userID)
+		}
+		resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.desc)
+	}
+}
+
+func TestAdminFlagsHandler(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	flags.FreeTextsPerDay = 3
+	defer func() { flags.FreeTextsPerDay = 0 }()
+
+	req := httptest.NewRequest("GET", "http://example.com/admin/flags", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, body := fakeRequest(req, wrapAdminHandler(adminFlagsHandler))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for an admin")
+
+	var f Flags
+	err := json.Unmarshal(body, &f)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, flags, f, "got the current flags")
+}
+
+func TestAdminTextsHandler(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	from := time.Date(2001, 2, 3, 0, 0, 0, 0, time.UTC)
+	for i, text := range []string{"test admin texts 1", "test admin texts 2", "test admin texts 3"} {
+		_, err := db.Exec(
+			`INSERT INTO submission (user_id, hash, created_at) VALUES ($1, $2, $3)`,
+			sha256String("Xiomara"), sha256String(text), from.Add(time.Duration(i)*time.Hour),
+		)
+		assert.Nil(t, err, "inserted submission")
+	}
+
+	get := func(query string) (*http.Response, submissionListDocument) {
+		req := httptest.NewRequest("GET", "http://example.com/text?"+query, nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		resp, body := fakeRequest(req, wrapAdminHandler(adminTextsHandler))
+		var ld submissionListDocument
+		if resp.StatusCode == http.StatusOK {
+			err := json.Unmarshal(body, &ld)
+			assert.Nil(t, err, "no error unmarshalling response body")
+		}
+		return resp, ld
+	}
+
+	resp, ld := get("from=2001-02-03T00:00:00Z&to=2001-02-03T01:30:00Z&limit=1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a valid range")
+	if assert.Len(t, ld.Submissions, 1, "got one submission on the first page") {
+		sd := ld.Submissions[0]
+		assert.Equal(t, sha256String("test admin texts 1"), sd.Hash, "got the hash")
+		assert.Equal(t, sha256String("Xiomara"), sd.UserID, "got the submitter")
+		assert.True(t, from.Equal(sd.CreatedAt.Time), "got the submission time")
+	}
+	if assert.NotNil(t, ld.NextOffset, "there is a next page") {
+		assert.Equal(t, 1, *ld.NextOffset, "got the next offset")
+	}
+
+	resp, ld = get("from=2001-02-03T00:00:00Z&to=2001-02-03T01:30:00Z&limit=1&offset=1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the second page")
+	assert.Len(t, ld.Submissions, 1, "got one submission on the second page")
+	assert.Nil(t, ld.NextOffset, "the second page is the last one")
+
+	req := httptest.NewRequest("GET", "http://example.com/text?from=2001-02-03T00:00:00Z&to=2001-02-03T01:30:00Z", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, body := fakeRequest(req, wrapAdminHandler(adminTextsHandler))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for NDJSON")
+	assert.Equal(t, "application/x-ndjson; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if assert.Len(t, lines, 2, "got one line per submission") {
+		var sd submissionDocument
+		err := json.Unmarshal([]byte(lines[1]), &sd)
+		assert.Nil(t, err, "no error unmarshalling a line")
+		assert.Equal(t, sha256String("test admin texts 2"), sd.Hash, "got the second submission on the second line")
+	}
+
+	for query, desc := range map[string]string{
+		"to=2001-02-03T00:00:00Z":                                   "no from",
+		"from=yesterday&to=2001-02-03T00:00:00Z":                    "a bad timestamp",
+		"from=2001-02-04T00:00:00Z&to=2001-02-03T00:00:00Z":         "from after to",
+		"from=2001-01-01T00:00:00Z&to=2001-12-31T00:00:00Z":         "a range that's too wide",
+		"from=2001-02-03T00:00:00Z&to=2001-02-04T00:00:00Z&limit=0": "a limit of 0",
+	} {
+		resp, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for %s", desc)
+	}
+}
+
+func TestAdminTextMetaHandler(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	text := "test admin text meta handler"
+	_, err := storeText(context.Background(), db, text, sha256String(text), sha256String("Xiomara"), 0)
+	assert.Nil(t, err, "stored text")
+
+	get := func(hash string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com/admin/text/"+hash+"/meta", nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		return fakeRequest(req, makeRouter().ServeHTTP)
+	}
+
+	resp, body := get(sha256String(text))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a stored text")
+	assert.NotContains(t, string(body), text, "the text itself isn't included")
+
+	var md textMetaDocument
+	err = json.Unmarshal(body, &md)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	if assert.NotNil(t, md.CreatedBy, "got the submitter") {
+		assert.Equal(t, sha256String("Xiomara"), *md.CreatedBy, "Xiomara stored the text")
+	}
+	assert.Nil(t, md.LastAccessedAt, "the text hasn't been read")
+	assert.Equal(t, int64(len(text)), md.Bytes, "got the size of the text")
+
+	resp, _ = get(sha256String("test admin text meta handler, never stored"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for an unknown hash")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+type apiKeyDocument struct {
+	APIKey string `json:"api_key"`
+}
+
+// apiKeyRotateHandler replaces all of the user's API keys with a new one. We
+// only store the key's hash, so this response is the only time the client
+// ever sees the key. Any old key stops working as soon as we commit.
+func apiKeyRotateHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	key, err := randomToken()
+	if err != nil {
+		log.Printf("Failed to make an API key: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to begin a transaction: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(withTables(`DELETE FROM {api_key} WHERE user_id = $1`), userID)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to delete API keys for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	revoked, _ := res.RowsAffected()
+
+	_, err = tx.Exec(withTables(`INSERT INTO {api_key} (key_hash, user_id) VALUES ($1, $2)`), sha256String(key), userID)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to insert API key for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit API key rotation for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Rotated the API key for user_id = %s, revoking %d old keys", userID, revoked)
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSONResponse(w, apiKeyDocument{APIKey: key})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// recordAdminAction adds a row to the admin audit log for a change made by the
+// admin making r. It should run in the same transaction as the change, so
+// that there's never a change without a record of it, or the other way round.
+func recordAdminAction(ctx context.Context, q querier, r *http.Request, action string, detail interface{}) error {
+	raw, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(
+		ctx,
+		withTables(`INSERT INTO {admin_audit} (admin_id, action, detail) VALUES ($1, $2, $3)`),
+		// With binary_parameters lib/pq sends a []byte as binary, which
+		// Postgres only accepts for bytea, so JSONB goes as a string.
+		requestUserID(r), action, string(raw),
+	)
+	dbBreaker.recordContext(ctx, err)
+	if err != nil {
+		log.Printf("Failed to record the admin action %s by user_id = %s: %v", action, requestUserID(r), err)
+	}
+	return err
+}
+
+type auditEntryDocument struct {
+	ID        int64           `json:"id"`
+	AdminID   string          `json:"admin_id"`
+	Action    string          `json:"action"`
+	Detail    json.RawMessage `json:"detail"`
+	CreatedAt jsonTime        `json:"created_at"`
+}
+
+// auditListDocument is one page of the audit log. NextOffset is the offset of
+// the next page, or null if this is the last one. Truncated is set when
+// maxPageBytes cut the page short of the limit.
+type auditListDocument struct {
+	Entries    []auditEntryDocument `json:"entries"`
+	NextOffset *int                 `json:"next_offset"`
+	Truncated  bool                 `json:"truncated"`
+}
+
+// adminAuditHandler lists the admin audit log, newest first.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	// We fetch one extra row to find out whether there's another page.
+	var rows *sql.Rows
+	err := withReadFallback(func(q *sql.DB) (err error) {
+		rows, err = q.Query(
+			withTables(`SELECT audit_id, admin_id, action, detail, created_at FROM {admin_audit}
+			  ORDER BY audit_id DESC
+			  LIMIT $1 OFFSET $2`),
+			limit+1, offset,
+		)
+		return err
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to list the admin audit log failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	ld := auditListDocument{Entries: []auditEntryDocument{}}
+	for rows.Next() {
+		var ed auditEntryDocument
+		var detail []byte
+		if err := rows.Scan(&ed.ID, &ed.AdminID, &ed.Action, &detail, &ed.CreatedAt); err != nil {
+			log.Printf("Failed to scan an admin audit entry: %v", err)
+			sendStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ed.Detail = detail
+		ld.Entries = append(ld.Entries, ed)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list the admin audit log: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	ld.Entries, ld.NextOffset, ld.Truncated = trimPage(ld.Entries, limit, offset)
+	sendJSONResponse(w, ld)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuditHandler(t *testing.T) {
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+	router := makeRouter()
+
+	userID := sha256String("Xiomara")
+	put := func(body string) {
+		req := httptest.NewRequest("PUT", "http://example.com/admin/user/"+userID+"/entitlements", bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", adminID)
+		resp, _ := fakeRequest(req, router.ServeHTTP)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 setting entitlements")
+	}
+	audit := func(query, asUser string) (*http.Response, auditListDocument) {
+		req := httptest.NewRequest("GET", "http://example.com/admin/audit"+query, nil)
+		req.Header.Set("X-HashText-User-ID", asUser)
+		resp, body := fakeRequest(req, router.ServeHTTP)
+		var ld auditListDocument
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(body, &ld), "no error unmarshalling response body")
+		}
+		return resp, ld
+	}
+
+	put(`{"max_text_bytes":2048}`)
+	put(`{}`)
+
+	resp, ld := audit("?limit=1", adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the audit log")
+	if assert.Len(t, ld.Entries, 1, "got one entry") {
+		e := ld.Entries[0]
+		assert.Equal(t, adminID, e.AdminID, "recorded who made the change")
+		assert.Equal(t, "user.entitlements.set", e.Action, "recorded the action")
+		assert.JSONEq(t, `{"user_id":"`+userID+`","entitlements":{}}`, string(e.Detail), "the newest entry comes first")
+	}
+	if assert.NotNil(t, ld.NextOffset, "got a next page") {
+		resp, ld = audit("?limit=1&offset=1", adminID)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the next page")
+		if assert.Len(t, ld.Entries, 1, "got one entry") {
+			assert.JSONEq(t, `{"user_id":"`+userID+`","entitlements":{"max_text_bytes":2048}}`, string(ld.Entries[0].Detail), "got the earlier change")
+		}
+	}
+
+	resp, _ = audit("", sha256String("Xiomara"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for a user who isn't an admin")
+}
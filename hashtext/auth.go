@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// An authenticator works out which user made a request from one kind of
+// credential. It returns an empty user_id and a nil error if the request
+// doesn't carry that kind of credential or if the credential doesn't belong to
+// a known user. It returns an *authError if it wants to tell the client why
+// their credential was rejected, and any other error if it couldn't check the
+// credential at all, say because the database is down.
+type authenticator interface {
+	authenticate(r *http.Request) (userID string, err error)
+}
+
+// authError explains why a credential was rejected. The code is sent to the
+// client in the 401 response.
+type authError struct {
+	code string
+}
+
+func (e *authError) Error() string {
+	return e.code
+}
+
+var errUnauthenticated = errors.New("no authenticator recognized the request")
+
+// authenticators maps the names used in HASHTEXT_AUTH_CHAIN to the
+// authenticator they refer to.
+var authenticators = map[string]authenticator{
+	"header":  headerAuthenticator{},
+	"api-key": apiKeyAuthenticator{},
+}
+
+// authChain is tried in order for each request, and the first authenticator
+// to recognize the request wins.
+var authChain = []authenticator{headerAuthenticator{}, apiKeyAuthenticator{}}
+
+func parseAuthChain(s string) ([]authenticator, error) {
+	var chain []authenticator
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		a, ok := authenticators[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("the chain must contain at least one authenticator")
+	}
+	return chain, nil
+}
+
+// authenticate returns the user_id from the first authenticator in the chain
+// that recognizes the request. If none of them do, it returns the first error
+// that isn't an *authError, as we couldn't tell whether that credential was
+// good, then the first *authError, or errUnauthenticated.
+func authenticate(r *http.Request) (string, error) {
+	var rejected, failed error
+	for _, a := range authChain {
+		userID, err := a.authenticate(r)
+		if userID != "" {
+			return userID, nil
+		}
+		var ae *authError
+		switch {
+		case err == nil:
+		case errors.As(err, &ae):
+			if rejected == nil {
+				rejected = err
+			}
+		case failed == nil:
+			failed = err
+		}
+	}
+	if failed != nil {
+		return "", failed
+	}
+	if rejected != nil {
+		return "", rejected
+	}
+	return "", errUnauthenticated
+}
+
+type contextKey int
+
+const (
+	userIDContextKey contextKey = iota
+	entitlementsContextKey
+	selftestContextKey
+)
+
+func withUserID(r *http.Request, userID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID))
+}
+
+// requestUserID returns the user_id that wrapHandler resolved for this
+// request, or an empty string for an unauthenticated request.
+func requestUserID(r *http.Request) string {
+	userID, _ := r.Context().Value(userIDContextKey).(string)
+	return userID
+}
+
+// headerAuthenticator treats the X-HashText-User-ID header as the user_id.
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) authenticate(r *http.Request) (string, error) {
+	userID := r.Header.Get("X-HashText-User-ID")
+	if userID == "" {
+		return "", nil
+	}
+	exists, err := userExists(userID)
+	if !exists {
+		return "", err
+	}
+	return userID, nil
+}
+
+// userExists reports whether there's a user with userID. It returns an error
+// if it couldn't find out, which isn't the same as the user not existing.
+func userExists(userID string) (bool, error) {
+	var found bool
+	err := db.QueryRow(withTables(`SELECT 1 FROM {user} WHERE user_id = $1`), userID).Scan(&found)
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		log.Printf("Query to look up user failed: %v", err)
+		return false, err
+	}
+
+	return found, nil
+}
+
+// apiKeyAuthenticator looks up the key in the X-HashText-API-Key header. We
+// only store the SHA256 hash of each key.
+type apiKeyAuthenticator struct{}
+
+func (apiKeyAuthenticator) authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get("X-HashText-API-Key")
+	if key == "" {
+		return "", nil
+	}
+
+	var userID string
+	err := db.QueryRow(withTables(`SELECT user_id FROM {api_key} WHERE key_hash = $1`), sha256String(key)).Scan(&userID)
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		log.Printf("Query to look up API key failed: %v", err)
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// devUserAuthenticator treats a request that carries no credentials at all as
+// coming from a fixed user, so that developers can poke at a local server
+// without setting headers. It must go last in the chain. parseFlags refuses to
+// enable it in production.
+type devUserAuthenticator struct {
+	userID string
+}
+
+func (a devUserAuthenticator) authenticate(r *http.Request) (string, error) {
+	for _, h := range []string{"X-HashText-User-ID", "X-HashText-API-Key", "Authorization"} {
+		if r.Header.Get(h) != "" {
+			return "", nil
+		}
+	}
+	return a.userID, nil
+}
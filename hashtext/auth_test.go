@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	_, err := db.Exec(`INSERT INTO api_key (key_hash, user_id) VALUES ($1, $2)`,
+		sha256String("xiomara's key"), sha256String("Xiomara"))
+	assert.Nil(t, err, "inserted API key")
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	userID, _ := apiKeyAuthenticator{}.authenticate(r)
+	assert.Equal(t, "", userID, "no user_id when there is no X-HashText-API-Key header")
+
+	r.Header.Set("X-HashText-API-Key", "not a key")
+	userID, _ = apiKeyAuthenticator{}.authenticate(r)
+	assert.Equal(t, "", userID, "no user_id for an unknown key")
+
+	r.Header.Set("X-HashText-API-Key", "xiomara's key")
+	userID, err = authenticate(r)
+	assert.Nil(t, err, "the default chain accepts an API key")
+	assert.Equal(t, sha256String("Xiomara"), userID, "returns the user_id for Xiomara")
+
+	req := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+	req.Header.Set("X-HashText-API-Key", "xiomara's key")
+	resp, _ := fakeRequest(req, wrapHandler(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, sha256String("Xiomara"), requestUserID(r), "handler sees the authenticated user_id")
+	}))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for an API key")
+}
+
+func TestAPIKeyRotateHandler(t *testing.T) {
+	userID := sha256String("Jane")
+	_, err := db.Exec(`INSERT INTO api_key (key_hash, user_id) VALUES ($1, $2)`, sha256String("jane's old key"), userID)
+	assert.Nil(t, err, "inserted API key")
+
+	req := httptest.NewRequest("POST", "http://example.com/user/me/api-key/rotate", nil)
+	req.Header.Set("X-HashText-API-Key", "jane's old key")
+	resp, body := fakeRequest(req, wrapHandler(apiKeyRotateHandler))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when rotating the key")
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"), "response isn't cached")
+
+	var kd apiKeyDocument
+	err = json.Unmarshal(body, &kd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.NotEqual(t, "", kd.APIKey, "got a new key")
+
+	req = httptest.NewRequest("GET", "http://example.com/user/me", nil)
+	req.Header.Set("X-HashText-API-Key", "jane's old key")
+	resp, _ = fakeRequest(req, wrapHandler(userHandler))
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "returned 401 for the old key")
+
+	req.Header.Set("X-HashText-API-Key", kd.APIKey)
+	resp, _ = fakeRequest(req, wrapHandler(userHandler))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the new key")
+}
+
+func TestParseAuthChain(t *testing.T) {
+	chain, err := parseAuthChain("api-key, header")
+	assert.Nil(t, err, "no error parsing a valid chain")
+	assert.Equal(t, []authenticator{apiKeyAuthenticator{}, headerAuthenticator{}}, chain, "chain is in the configured order")
+
+	_, err = parseAuthChain("header,carrier-pigeon")
+	assert.NotNil(t, err, "error for an unknown authenticator")
+
+	_, err = parseAuthChain(" , ")
+	assert.NotNil(t, err, "error for an empty chain")
+
+	saved := authChain
+	authChain, _ = parseAuthChain("api-key")
+	defer func() { authChain = saved }()
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	_, err = authenticate(r)
+	assert.Equal(t, errUnauthenticated, err, "the header is ignored when it's not in the chain")
+}
+
+func TestDevUserAuthenticator(t *testing.T) {
+	a := devUserAuthenticator{userID: sha256String("Jane")}
+
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	userID, err := a.authenticate(r)
+	assert.Nil(t, err, "no error without credentials")
+	assert.Equal(t, sha256String("Jane"), userID, "a request without credentials is the dev user")
+
+	for _, h := range []string{"X-HashText-User-ID", "X-HashText-API-Key", "Authorization"} {
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set(h, "something")
+		userID, _ := a.authenticate(r)
+		assert.Equal(t, "", userID, "a request with %s isn't the dev user", h)
+	}
+}
+
+// stubAuthenticator returns the same thing for every request.
+type stubAuthenticator struct {
+	userID string
+	err    error
+}
+
+func (a stubAuthenticator) authenticate(r *http.Request) (string, error) {
+	return a.userID, a.err
+}
+
+func TestAuthenticateLookupFailure(t *testing.T) {
+	saved := authChain
+	defer func() { authChain = saved }()
+	rejected := &authError{"token_expired"}
+	down := errors.New("the database is down")
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+
+	authChain = []authenticator{stubAuthenticator{err: rejected}, stubAuthenticator{err: down}}
+	_, err := authenticate(r)
+	assert.Equal(t, down, err, "a failed lookup wins over a rejected credential")
+
+	authChain = append(authChain, stubAuthenticator{userID: "someone"})
+	userID, err := authenticate(r)
+	assert.Nil(t, err, "no error when a later authenticator recognizes the request")
+	assert.Equal(t, "someone", userID, "got the user from the later authenticator")
+
+	authChain = []authenticator{stubAuthenticator{err: down}}
+	resp, _ := fakeRequest(r, wrapHandler(userHandler))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 rather than 401 when the lookup failed")
+}
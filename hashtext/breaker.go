@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops us from hammering the database while it's failing.
+// After threshold consecutive failures it opens and requests fail fast for the
+// cooldown period. Once the cooldown is over it lets a single request through
+// to see whether the database has recovered. If that request succeeds the
+// breaker closes again, otherwise it reopens for another cooldown. A probe
+// that finishes without using the database, or that never finishes, doesn't
+// keep the breaker half-open: the next request after release, or after
+// another cooldown, becomes the probe instead.
+//
+// A nil *circuitBreaker always allows requests, which is how the breaker is
+// turned off.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// probeAt is when the current probe was let through while half-open.
+	// It's zero when there's no probe in progress.
+	probeAt time.Time
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a request may use the database. When it returns
+// false it also returns how long the caller should wait before retrying. When
+// probe isn't zero the request is the one testing the database while the
+// breaker is half-open, and the caller must pass probe to release once the
+// request is done.
+func (cb *circuitBreaker) allow() (ok bool, retryAfter time.Duration, probe time.Time) {
+	if cb == nil {
+		return true, 0, time.Time{}
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	switch cb.state {
+	case breakerOpen:
+		elapsed := now.Sub(cb.openedAt)
+		if elapsed < cb.cooldown {
+			return false, cb.cooldown - elapsed, time.Time{}
+		}
+		cb.state = breakerHalfOpen
+		cb.probeAt = now
+		return true, 0, now
+	case breakerHalfOpen:
+		// Someone else is already testing the waters, unless they've been
+		// at it so long that they've probably hung.
+		elapsed := now.Sub(cb.probeAt)
+		if elapsed < cb.cooldown {
+			return false, cb.cooldown - elapsed, time.Time{}
+		}
+		cb.probeAt = now
+		return true, 0, now
+	}
+	return true, 0, time.Time{}
+}
+
+// release ends a probe that allow let through. If the probe didn't record
+// anything, the breaker stays half-open and the next request becomes the
+// probe. A probe that was replaced after hanging past the cooldown leaves its
+// replacement alone.
+func (cb *circuitBreaker) release(probe time.Time) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.probeAt.Equal(probe) {
+		cb.probeAt = time.Time{}
+	}
+}
+
+// record tells the breaker how a database operation went. sql.ErrNoRows is a
+// perfectly healthy answer from the database, so it counts as a success.
+func (cb *circuitBreaker) record(err error) {
+	if cb == nil {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil || err == sql.ErrNoRows {
+		cb.failures = 0
+		cb.state = breakerClosed
+		return
+	}
+
+	cb.failures++
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = breakerOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// recordContext is record for an operation made with ctx. If ctx is done the
+// operation was most likely cancelled because the client went away, which
+// says nothing about the database, so it isn't counted either way.
+func (cb *circuitBreaker) recordContext(ctx context.Context, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	cb.record(err)
+}
+
+func (cb *circuitBreaker) currentState() string {
+	if cb == nil {
+		return breakerClosed
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
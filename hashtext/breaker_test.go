@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	cb := newCircuitBreaker(2, 30*time.Second)
+	cb.now = func() time.Time { return now }
+
+	dbErr := errors.New("connection refused")
+
+	cb.record(dbErr)
+	ok, _, _ := cb.allow()
+	assert.True(t, ok, "still closed after one failure")
+
+	cb.record(sql.ErrNoRows)
+	cb.record(dbErr)
+	ok, _, _ = cb.allow()
+	assert.True(t, ok, "sql.ErrNoRows resets the failure count")
+
+	cb.record(dbErr)
+	ok, retry, _ := cb.allow()
+	assert.False(t, ok, "open after two consecutive failures")
+	assert.Equal(t, 30*time.Second, retry, "retry after the full cooldown")
+	assert.Equal(t, breakerOpen, cb.currentState(), "state is open")
+
+	now = now.Add(10 * time.Second)
+	ok, retry, _ = cb.allow()
+	assert.False(t, ok, "still open during the cooldown")
+	assert.Equal(t, 20*time.Second, retry, "retry after the rest of the cooldown")
+
+	now = now.Add(20 * time.Second)
+	ok, _, _ = cb.allow()
+	assert.True(t, ok, "lets one request through after the cooldown")
+	assert.Equal(t, breakerHalfOpen, cb.currentState(), "state is half-open")
+	ok, _, _ = cb.allow()
+	assert.False(t, ok, "only one request at a time while half-open")
+
+	cb.record(dbErr)
+	assert.Equal(t, breakerOpen, cb.currentState(), "a failure while half-open reopens the breaker")
+
+	now = now.Add(30 * time.Second)
+	ok, _, _ = cb.allow()
+	assert.True(t, ok, "lets one request through after the cooldown")
+	cb.record(nil)
+	assert.Equal(t, breakerClosed, cb.currentState(), "a success while half-open closes the breaker")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cb.record(dbErr)
+	cb.recordContext(ctx, dbErr)
+	ok, _, _ = cb.allow()
+	assert.True(t, ok, "a failure after the context was cancelled isn't counted")
+	cb.recordContext(context.Background(), dbErr)
+	ok, _, _ = cb.allow()
+	assert.False(t, ok, "a failure with a live context is counted")
+
+	var disabled *circuitBreaker
+	disabled.record(dbErr)
+	ok, _, _ = disabled.allow()
+	assert.True(t, ok, "a nil breaker always allows requests")
+}
+
+func TestCircuitBreakerProbeWithoutRecord(t *testing.T) {
+	now := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	cb := newCircuitBreaker(1, 30*time.Second)
+	cb.now = func() time.Time { return now }
+
+	cb.record(errors.New("connection refused"))
+	now = now.Add(30 * time.Second)
+	ok, _, probe := cb.allow()
+	assert.True(t, ok && !probe.IsZero(), "the first request after the cooldown is the probe")
+	ok, retry, _ := cb.allow()
+	assert.False(t, ok, "nobody else gets through while the probe runs")
+	assert.Equal(t, 30*time.Second, retry, "retry once the probe has had a cooldown")
+
+	now = now.Add(30 * time.Second)
+	hung := probe
+	ok, _, probe = cb.allow()
+	assert.True(t, ok && !probe.IsZero(), "a probe that never finishes is replaced after a cooldown")
+	cb.release(hung)
+	ok, _, _ = cb.allow()
+	assert.False(t, ok, "the hung probe finishing late doesn't free its replacement's slot")
+
+	cb.release(probe)
+	assert.Equal(t, breakerHalfOpen, cb.currentState(), "a probe that didn't record anything leaves the breaker half-open")
+	ok, _, probe = cb.allow()
+	assert.True(t, ok && !probe.IsZero(), "the next request after a release is the probe")
+	cb.record(nil)
+	ok, _, probe = cb.allow()
+	assert.True(t, ok, "a success from the new probe closes the breaker")
+	assert.True(t, probe.IsZero(), "there's no probe while closed")
+}
+
+func TestBreakerProbeReleasedByHandler(t *testing.T) {
+	dbBreaker = newCircuitBreaker(1, time.Hour)
+	defer func() { dbBreaker = nil }()
+	dbBreaker.record(errors.New("connection refused"))
+	dbBreaker.openedAt = dbBreaker.openedAt.Add(-time.Hour)
+
+	var calls int
+	h := wrapHandlerWithMode(authNone, func(w http.ResponseWriter, r *http.Request) { calls++ })
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		resp, _ := fakeRequest(req, h)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "request %d wasn't stuck behind a probe that never touched the database", i)
+	}
+	assert.Equal(t, 3, calls, "every request reached the handler")
+
+	panics := wrapHandlerWithMode(authNone, func(w http.ResponseWriter, r *http.Request) { panic("oops") })
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	fakeRequest(req, recoverMiddleware(http.HandlerFunc(panics)).ServeHTTP)
+	req = httptest.NewRequest("GET", "http://example.com/", nil)
+	resp, _ := fakeRequest(req, h)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "a probe that panicked was released")
+}
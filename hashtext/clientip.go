@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedCIDRs are our own networks, like the load balancer's and other
+// internal services'. We believe the X-Forwarded-For header only from them,
+// and per-client limits don't apply to them.
+var trustedCIDRs []*net.IPNet
+
+// parseCIDRs parses a comma-separated list of CIDRs, like "10.0.0.0/8".
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedIP(ip net.IP) bool {
+	for _, n := range trustedCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request. When the
+// request came through one of our own proxies, that's the last address in
+// X-Forwarded-For that isn't one of ours. Anything before it was written by
+// the client and can't be believed.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedIP(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !trustedIP(hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedCIDRs, err = parseCIDRs("10.0.0.0/8, 192.168.0.0/16")
+	defer func() { trustedCIDRs = nil }()
+	assert.NoError(t, err, "parsed the trusted CIDRs")
+
+	for _, c := range []struct {
+		name, remoteAddr, forwardedFor, expected string
+	}{
+		{"untrusted peer", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted peer can't pick its IP", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"spoofed entries before the proxy's are ignored", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"trusted peer without a proxy", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"garbage stops the search", "10.0.0.1:1234", "198.51.100.7, nonsense", "10.0.0.1"},
+		{"IPv6", "[2001:db8::1]:1234", "", "2001:db8::1"},
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		assert.Equal(t, c.expected, clientIP(req).String(), c.name)
+	}
+
+	_, err = parseCIDRs("10.0.0.0/8,10.0.0.1")
+	assert.Error(t, err, "an address without a prefix length isn't a CIDR")
+}
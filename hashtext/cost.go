@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+)
+
+// costDocument is what submitting a text would cost the user right now, and
+// whether they have enough credit for the submission to go through.
+type costDocument struct {
+	Cost       credit `json:"cost"`
+	Sufficient bool   `json:"sufficient"`
+}
+
+// textCostHandler previews the charge for a text without storing it or
+// charging anything. The text is read and checked just as textHandler does,
+// so a text that would be rejected there is rejected here too. The answer
+// can change before the client submits, for example when the user's free
+// texts run out or someone else stores the same text first.
+func textCostHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+	text, hash, ok := readSubmittedText(w, r)
+	if !ok || !withinStorageQuota(w, r, text, hash) {
+		return
+	}
+	if !flags.creditEnabled() {
+		sendJSONResponse(w, costDocument{Cost: 0, Sufficient: true})
+		return
+	}
+
+	var balance credit
+	var stored bool
+	err := db.QueryRow(
+		withTables(`SELECT credit, EXISTS (SELECT 1 FROM {hash_text} WHERE hash = $2)
+		   FROM {user} WHERE user_id = $1`),
+		userID, hash,
+	).Scan(&balance, &stored)
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		sendStatus(w, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Query to look up credit for user_id = %s failed: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	// This mirrors textHandler, which only charges for a text that it stores,
+	// whether it stores it before responding or in an async insert, but
+	// still turns away a user who can't afford a new text unless it's one of
+	// their free ones.
+	free := withinFreeQuota(userID)
+	cd := costDocument{Cost: textPrice, Sufficient: free || balance >= textPrice}
+	if free || stored {
+		cd.Cost = 0
+	}
+	sendJSONResponse(w, cd)
+}
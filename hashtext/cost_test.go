@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextCostHandler(t *testing.T) {
+	userID := sha256String("Yusuf")
+	execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, 'Yusuf', 1)`, userID)
+	stored := "test text cost handler stored"
+	_, err := storeText(context.Background(), db, stored, hashText(stored), sha256String("Jane"), 0)
+	assert.Nil(t, err, "no error storing text")
+
+	cost := func(text string) (*http.Response, costDocument) {
+		j, _ := json.Marshal(map[string]string{"text": text})
+		resp, body := holdRequest("/text/cost", userID, string(j))
+		var cd costDocument
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(body, &cd), "no error unmarshalling response body")
+		}
+		return resp, cd
+	}
+
+	resp, cd := cost("test text cost handler new")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a new text")
+	assert.Equal(t, costDocument{Cost: textPrice, Sufficient: true}, cd, "a new text costs the price")
+
+	resp, cd = cost(stored)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a stored text")
+	assert.Equal(t, costDocument{Cost: 0, Sufficient: true}, cd, "a stored text is free")
+
+	// Async inserts only charge for new texts too.
+	inserts = newInsertQueue(1)
+	resp, cd = cost(stored)
+	inserts = nil
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a stored text with async inserts")
+	assert.Equal(t, costDocument{Cost: 0, Sufficient: true}, cd, "a stored text is free with async inserts")
+
+	execWithCheck(db, `UPDATE "user" SET credit = 0 WHERE user_id = $1`, userID)
+	resp, cd = cost("test text cost handler new")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without enough credit")
+	assert.Equal(t, costDocument{Cost: textPrice, Sufficient: false}, cd, "a new text isn't affordable without credit")
+	assert.Equal(t, int64(0), creditFor(t, userID), "nothing was charged")
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, hashText("test text cost handler new")).Scan(&count)
+	assert.Nil(t, err, "no error looking up hash_text")
+	assert.Equal(t, 0, count, "text was not stored")
+
+	flags.FreeTextsPerDay = 5
+	resp, cd = cost("test text cost handler new")
+	flags.FreeTextsPerDay = 0
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with free texts left")
+	assert.Equal(t, costDocument{Cost: 0, Sufficient: true}, cd, "a free text costs nothing")
+
+	resp, _ = holdRequest("/text/cost", userID, `not json`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a body textHandler would reject")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A credit is an amount of credit. Normally it's a whole number of credits.
+// With HASHTEXT_MONEY_CREDIT it's an amount of money in hundredths, so that
+// 1250 is 12.50. Either way it's an integer, so our arithmetic is exact, and
+// the database does its own arithmetic on a BIGINT or NUMERIC column.
+//
+// In money mode amounts are sent to and read from clients as strings like
+// "12.50", so that no client has to round a float.
+type credit int64
+
+// moneyScale is how many hundredths there are in one unit of money.
+const moneyScale = 100
+
+// textPrice is what storing a new text costs.
+var textPrice = credit(1)
+
+// creditScale is how many credits there are in one whole unit.
+func creditScale() credit {
+	if flags.MoneyCredit {
+		return moneyScale
+	}
+	return 1
+}
+
+var (
+	wholeCreditPattern = regexp.MustCompile(`^-?[0-9]+$`)
+	moneyPattern       = regexp.MustCompile(`^(-?)([0-9]+)(?:\.([0-9]{1,2}))?$`)
+)
+
+// parseCredit parses an amount as a client or Postgres writes it. In money
+// mode it takes at most two decimal places. We never round, so an amount we
+// can't represent exactly is an error.
+func parseCredit(s string) (credit, error) {
+	if !flags.MoneyCredit {
+		if !wholeCreditPattern.MatchString(s) {
+			return 0, fmt.Errorf("credit must be a whole number, not %q", s)
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		return credit(n), err
+	}
+
+	// Postgres writes a NUMERIC(20,2) with exactly two decimal places,
+	// but a column with more places would show up here as trailing zeros.
+	if i := strings.IndexByte(s, '.'); i >= 0 && len(s)-i > 3 {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	m := moneyPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("an amount of money must be a number with at most two decimal places, not %q", s)
+	}
+	units, err := strconv.ParseInt(m[2], 10, 64)
+	if err != nil || units > (1<<63-1)/moneyScale-1 {
+		return 0, fmt.Errorf("the amount %q is too large", s)
+	}
+	hundredths, _ := strconv.ParseInt((m[3] + "00")[:2], 10, 64)
+	c := credit(units*moneyScale + hundredths)
+	if m[1] == "-" {
+		c = -c
+	}
+	return c, nil
+}
+
+func (c credit) String() string {
+	if !flags.MoneyCredit {
+		return strconv.FormatInt(int64(c), 10)
+	}
+	sign := ""
+	n := uint64(c)
+	if c < 0 {
+		sign = "-"
+		n = -n
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, n/moneyScale, n%moneyScale)
+}
+
+func (c credit) MarshalJSON() ([]byte, error) {
+	if !flags.MoneyCredit {
+		return []byte(c.String()), nil
+	}
+	return json.Marshal(c.String())
+}
+
+// UnmarshalJSON takes a JSON number of credits, or a string like "12.50" in
+// money mode. A number is never accepted in money mode, as the client may
+// already have rounded it.
+func (c *credit) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if flags.MoneyCredit {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return fmt.Errorf("an amount of money must be a string like \"12.50\"")
+		}
+	}
+	n, err := parseCredit(s)
+	if err != nil {
+		return err
+	}
+	*c = n
+	return nil
+}
+
+// Scan reads a BIGINT column, which lib/pq gives us as an int64 of whole
+// units, or a NUMERIC one, which it gives us as text.
+func (c *credit) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*c = credit(v) * creditScale()
+		return nil
+	case []byte:
+		n, err := parseCredit(string(v))
+		*c = n
+		return err
+	case string:
+		n, err := parseCredit(v)
+		*c = n
+		return err
+	}
+	return fmt.Errorf("cannot scan %T into a credit", src)
+}
+
+// Value sends the amount as text, which Postgres casts to the type of the
+// column it's compared with or assigned to.
+func (c credit) Value() (driver.Value, error) {
+	return c.String(), nil
+}
+
+// checkMoneyColumns makes sure the credit columns can hold fractions before
+// we start in money mode. Postgres would otherwise quietly round every amount
+// we write to a BIGINT column.
+func checkMoneyColumns() error {
+	for _, col := range []struct{ table, column string }{
+		{tables.User, "credit"},
+		{tables.CreditHold, "amount"},
+	} {
+		var dataType string
+		err := db.QueryRow(
+			`SELECT data_type FROM information_schema.columns
+			  WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`,
+			col.table, col.column,
+		).Scan(&dataType)
+		if err != nil {
+			return fmt.Errorf("could not look up the type of %s.%s: %v", col.table, col.column, err)
+		}
+		if dataType != "numeric" {
+			return fmt.Errorf("%s.%s is a %s column, but money mode needs a numeric one. Create the schema with make-schema -money", col.table, col.column, dataType)
+		}
+	}
+	return nil
+}
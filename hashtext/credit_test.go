@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreditIntegerMode(t *testing.T) {
+	for s, want := range map[string]credit{"0": 0, "42": 42, "-3": -3} {
+		c, err := parseCredit(s)
+		assert.Nil(t, err, "no error parsing %q", s)
+		assert.Equal(t, want, c, "parsed %q", s)
+		assert.Equal(t, s, c.String(), "formatted %q", s)
+	}
+	for _, s := range []string{"", "1.5", "1.00", "one", "99999999999999999999"} {
+		_, err := parseCredit(s)
+		assert.NotNil(t, err, "error parsing %q", s)
+	}
+
+	j, err := json.Marshal(userDocument{Credit: 12})
+	assert.Nil(t, err, "no error marshalling a user")
+	assert.Contains(t, string(j), `"credit":12,`, "credit is a JSON number")
+
+	var rd reserveDocument
+	assert.Nil(t, json.Unmarshal([]byte(`{"credits":5}`), &rd), "no error unmarshalling a number of credits")
+	assert.Equal(t, credit(5), rd.Credits, "got the credits")
+	assert.NotNil(t, json.Unmarshal([]byte(`{"credits":"5"}`), &rd), "error unmarshalling a string of credits")
+
+	var c credit
+	assert.Nil(t, c.Scan(int64(7)), "no error scanning a BIGINT")
+	assert.Equal(t, credit(7), c, "scanned a BIGINT")
+	assert.Nil(t, c.Scan([]byte("123")), "no error scanning a NUMERIC")
+	assert.Equal(t, credit(123), c, "scanned a NUMERIC")
+}
+
+func TestCreditMoneyMode(t *testing.T) {
+	flags.MoneyCredit = true
+	defer func() { flags.MoneyCredit = false }()
+
+	for s, want := range map[string]credit{
+		"0":      0,
+		"12":     1200,
+		"12.5":   1250,
+		"12.50":  1250,
+		"0.01":   1,
+		"-0.25":  -25,
+		"12.500": 1250,
+		"3.000":  300,
+	} {
+		c, err := parseCredit(s)
+		assert.Nil(t, err, "no error parsing %q", s)
+		assert.Equal(t, want, c, "parsed %q", s)
+	}
+	for _, s := range []string{"", ".5", "1.", "1.005", "0.001", "1e3", "12,50", "999999999999999999"} {
+		_, err := parseCredit(s)
+		assert.NotNil(t, err, "error parsing %q", s)
+	}
+
+	for c, want := range map[credit]string{0: "0.00", 1: "0.01", 1250: "12.50", -25: "-0.25", 100000: "1000.00"} {
+		assert.Equal(t, want, c.String(), "formatted %d hundredths", c)
+	}
+
+	j, err := json.Marshal(userDocument{Credit: 1250})
+	assert.Nil(t, err, "no error marshalling a user")
+	assert.Contains(t, string(j), `"credit":"12.50",`, "money is a JSON string")
+
+	var rd reserveDocument
+	assert.Nil(t, json.Unmarshal([]byte(`{"credits":"0.10"}`), &rd), "no error unmarshalling an amount of money")
+	assert.Equal(t, credit(10), rd.Credits, "got the amount")
+	assert.NotNil(t, json.Unmarshal([]byte(`{"credits":0.1}`), &rd), "error unmarshalling money as a JSON number")
+
+	var c credit
+	assert.Nil(t, c.Scan([]byte("12.34")), "no error scanning a NUMERIC")
+	assert.Equal(t, credit(1234), c, "scanned a NUMERIC")
+	assert.Nil(t, c.Scan(int64(7)), "no error scanning a BIGINT")
+	assert.Equal(t, credit(700), c, "scanned a BIGINT as whole units")
+
+	v, err := credit(5).Value()
+	assert.Nil(t, err, "no error getting a value")
+	assert.Equal(t, "0.05", v, "sent the amount as text")
+
+	counter := newCounter("money_total", "Money.", "").withFormat(formatCredit)
+	counter.add("", 1250)
+	counter.add("", 5)
+	var b strings.Builder
+	counter.write(&b)
+	assert.Contains(t, b.String(), "money_total 12.55\n", "wrote the counter as an amount of money")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// withBrokenDB runs f with db and readDB swapped for a closed pool, so every
+// query fails. This lets us drive the handlers' error branches without
+// actually breaking Postgres.
+func withBrokenDB(t *testing.T, f func()) {
+	broken, err := sql.Open("postgres", "host=127.0.0.1 dbname=hashtext")
+	assert.Nil(t, err, "no error opening a pool")
+	broken.Close()
+
+	savedDB, savedReadDB := db, readDB
+	db, readDB = broken, broken
+	defer func() { db, readDB = savedDB, savedReadDB }()
+
+	f()
+}
+
+func TestHandlersWithBrokenDB(t *testing.T) {
+	flags.DisableCredit = true
+	defer func() { flags.DisableCredit = false }()
+
+	userID := sha256String("Jane")
+	hash := sha256String("test handlers with broken db")
+
+	for _, tc := range []struct {
+		desc    string
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		vars    map[string]string
+		handler func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"GET /user/me", "GET", "/user/me", "", nil, nil, userHandler},
+		{"PATCH /user/me", "PATCH", "/user/me", `{"name":"Jane"}`, map[string]string{"If-Match": `"1"`}, nil, userPatchHandler},
+		{"POST /text", "POST", "/text", `{"text":"test handlers with broken db"}`, nil, nil, textHandler},
+		{"GET /text/{hash}", "GET", "/text/" + hash, "", nil, map[string]string{"hash": hash}, textHashHandler},
+		{"POST /text/reserve", "POST", "/text/reserve", `{"credits":1}`, nil, nil, reserveHandler},
+		{"POST /text/commit", "POST", "/text/commit", `{"hold_token":"x","text":"y"}`, nil, nil, commitHandler},
+		{"POST /text/release", "POST", "/text/release", `{"hold_token":"x"}`, nil, nil, releaseHandler},
+	} {
+		withBrokenDB(t, func() {
+			req := httptest.NewRequest(tc.method, "http://example.com"+tc.path, bytes.NewBufferString(tc.body))
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			if tc.vars != nil {
+				req = mux.SetURLVars(req, tc.vars)
+			}
+			resp, _ := fakeRequest(req, tc.handler)
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "%s returned 500 when the database fails", tc.desc)
+		})
+	}
+
+	withBrokenDB(t, func() {
+		req := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, _ := fakeRequest(req, wrapHandler(userHandler))
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 when the user can't be looked up")
+
+		req = httptest.NewRequest("GET", "http://example.com/user/me", nil)
+		req.Header.Set("X-HashText-API-Key", "some key")
+		resp, _ = fakeRequest(req, wrapHandler(userHandler))
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 when the API key can't be looked up")
+
+		req = httptest.NewRequest("GET", "http://example.com/readyz", nil)
+		resp, _ = fakeRequest(req, readyzHandler)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "readyz returned 503 when the database fails")
+	})
+}
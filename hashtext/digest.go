@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+)
+
+// textDigest is the encoding used for text hashes. Changing it changes every
+// text's hash, so texts stored under another encoding can no longer be found
+// and any URLs that clients have saved stop working.
+var textDigest = hashstore.DigestEncodings["hex"]
+
+// hashText returns the hash we store a text under, in the configured encoding.
+// Hashes that never leave the server, like user IDs and API keys, always use
+// sha256String instead.
+func hashText(s string) string {
+	h := sha256.New()
+	io.WriteString(h, s)
+	return textDigest.Encode(h.Sum(nil))
+}
+
+// hashReader hashes a text read from rd, which it never holds in memory all at
+// once, with newHash. The result is in the configured encoding, like every
+// other hash we send, so with sha256.New it's what hashText would return.
+func hashReader(newHash func() hash.Hash, rd io.Reader) (string, error) {
+	h := newHash()
+	if _, err := io.Copy(h, rd); err != nil {
+		return "", err
+	}
+	return textDigest.Encode(h.Sum(nil)), nil
+}
+
+// textAlgorithm is the algorithm every stored text is hashed with.
+const textAlgorithm = "sha256"
+
+// hashAlgorithms are the algorithms a client can ask for with ?algo= on the
+// endpoints that hash without storing anything. Texts are always stored under
+// their textAlgorithm hash, so that a text has exactly one hash.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// algorithmParam reads the algo query parameter, which defaults to
+// textAlgorithm. If ok is false it has already sent a 400.
+func algorithmParam(w http.ResponseWriter, r *http.Request) (name string, newHash func() hash.Hash, ok bool) {
+	name = r.URL.Query().Get("algo")
+	if name == "" {
+		name = textAlgorithm
+	}
+	newHash, ok = hashAlgorithms[name]
+	if !ok {
+		var names []string
+		for n := range hashAlgorithms {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		sendErrorMessage(w, fmt.Sprintf("algo must be one of %s, not %q", strings.Join(names, ", "), name), http.StatusBadRequest)
+		return "", nil, false
+	}
+	return name, newHash, true
+}
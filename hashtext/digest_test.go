@@ -0,0 +1,29 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestEncodings(t *testing.T) {
+	saved := textDigest
+	defer func() { textDigest = saved }()
+
+	for name, want := range map[string]string{
+		"hex":       "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"base64url": "LPJNul-wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ",
+		"base32":    "FTZE3OS7WCRQ4JXIHMVMLOPCTYNRMHS4D6TUEXTTAQZWFE4LTASA",
+	} {
+		de, err := hashstore.ParseDigestEncoding(name)
+		assert.Nil(t, err, "no error parsing %s", name)
+		textDigest = de
+		assert.Equal(t, want, hashText("hello"), "hashed text using %s", name)
+		assert.Regexp(t, regexp.MustCompile("^"+de.Pattern+"$"), want, "%s route pattern matches its hashes", name)
+	}
+
+	_, err := hashstore.ParseDigestEncoding("base58")
+	assert.NotNil(t, err, "error parsing an unknown encoding")
+}
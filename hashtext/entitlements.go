@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// entitlements override the global limits for one user, so that, say, a
+// premium user can submit larger texts. A nil field means the user gets the
+// global default.
+type entitlements struct {
+	MaxTextBytes  *int64 `json:"max_text_bytes,omitempty"`
+	UserByteQuota *int64 `json:"user_byte_quota,omitempty"`
+}
+
+func (e entitlements) maxTextBytes() int64 {
+	if e.MaxTextBytes != nil {
+		return *e.MaxTextBytes
+	}
+	return maxTextBytes
+}
+
+// userByteQuota is zero when the user has no quota, like the global
+// userByteQuota.
+func (e entitlements) userByteQuota() int64 {
+	if e.UserByteQuota != nil {
+		return *e.UserByteQuota
+	}
+	return userByteQuota
+}
+
+func (e entitlements) valid() bool {
+	return (e.MaxTextBytes == nil || *e.MaxTextBytes > 0) && (e.UserByteQuota == nil || *e.UserByteQuota >= 0)
+}
+
+func withEntitlements(r *http.Request, e entitlements) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), entitlementsContextKey, e))
+}
+
+// requestEntitlements returns the entitlements wrapHandler loaded for the
+// request's user. An anonymous request gets the global defaults.
+func requestEntitlements(r *http.Request) entitlements {
+	e, _ := r.Context().Value(entitlementsContextKey).(entitlements)
+	return e
+}
+
+func loadEntitlements(userID string) (entitlements, error) {
+	var raw []byte
+	err := db.QueryRow(withTables(`SELECT entitlements FROM {user} WHERE user_id = $1`), userID).Scan(&raw)
+	dbBreaker.record(err)
+	if err != nil {
+		return entitlements{}, err
+	}
+	var e entitlements
+	err = json.Unmarshal(raw, &e)
+	return e, err
+}
+
+// adminEntitlementsHandler replaces a user's entitlements with the ones in
+// the request body. Sending {} puts the user back on the global defaults.
+func adminEntitlementsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["user_id"]
+
+	var e entitlements
+	if !decodeJSONBody(w, r, &e) {
+		return
+	}
+	if !e.valid() {
+		sendErrorMessage(w, "max_text_bytes must be positive and user_byte_quota can't be negative", http.StatusBadRequest)
+		return
+	}
+	raw, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode entitlements: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	err = withTx(r.Context(), func(tx *sql.Tx) error {
+		// With binary_parameters lib/pq sends a []byte as binary, which
+		// Postgres only accepts for bytea, so JSONB goes as a string.
+		var updated string
+		err := tx.QueryRowContext(
+			r.Context(),
+			withTables(`UPDATE {user} SET entitlements = $1, version = version + 1 WHERE user_id = $2 RETURNING user_id`),
+			string(raw), userID,
+		).Scan(&updated)
+		dbBreaker.recordContext(r.Context(), err)
+		if err != nil {
+			return err
+		}
+		return recordAdminAction(r.Context(), tx, r, "user.entitlements.set", map[string]interface{}{
+			"user_id":      userID,
+			"entitlements": e,
+		})
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		sendStatus(w, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Failed to update entitlements for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %s set the entitlements for user_id = %s to %s", requestUserID(r), userID, raw)
+	sendJSONResponse(w, e)
+}
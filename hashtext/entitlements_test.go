@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntitlements(t *testing.T) {
+	var e entitlements
+	assert.Equal(t, maxTextBytes, e.maxTextBytes(), "max text size falls back to the global limit")
+	assert.Equal(t, userByteQuota, e.userByteQuota(), "byte quota falls back to the global quota")
+
+	maxBytes, quota := int64(10), int64(0)
+	e = entitlements{MaxTextBytes: &maxBytes, UserByteQuota: &quota}
+	assert.Equal(t, int64(10), e.maxTextBytes(), "got the user's max text size")
+	assert.Equal(t, int64(0), e.userByteQuota(), "got the user's byte quota")
+	assert.True(t, e.valid(), "a zero quota means no quota")
+
+	maxBytes = 0
+	assert.False(t, e.valid(), "a zero max text size isn't valid")
+}
+
+func TestAdminEntitlementsHandler(t *testing.T) {
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	userID := sha256String("Xiomara")
+	put := func(body string) *http.Response {
+		req := httptest.NewRequest("PUT", "http://example.com/admin/user/"+userID+"/entitlements", bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+		return resp
+	}
+	post := func(text string) *http.Response {
+		j, err := json.Marshal(map[string]string{"text": text})
+		assert.Nil(t, err, "no error marshalling textRequest")
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+		return resp
+	}
+
+	saved := maxTextBytes
+	maxTextBytes = 64
+	defer func() { maxTextBytes = saved }()
+	defer put(`{}`)
+
+	text := "test entitlements " + strings.Repeat("x", 64)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(text).StatusCode, "returned 413 over the global limit")
+
+	assert.Equal(t, http.StatusOK, put(`{"max_text_bytes":1024}`).StatusCode, "returned 200 setting entitlements")
+	assert.Equal(t, http.StatusOK, post(text).StatusCode, "returned 200 for a text within the user's own limit")
+
+	assert.Equal(t, http.StatusBadRequest, put(`{"max_text_bytes":0}`).StatusCode, "returned 400 for a zero max text size")
+
+	req := httptest.NewRequest("PUT", "http://example.com/admin/user/"+sha256String("Nobody")+"/entitlements", bytes.NewBufferString(`{}`))
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for an unknown user")
+}
+
+// TestJSONBWithPgBouncer runs the handlers that write JSONB with
+// binary_parameters, which sends []byte parameters as binary.
+func TestJSONBWithPgBouncer(t *testing.T) {
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	saved, savedPgBouncer := db, flags.PgBouncer
+	flags.PgBouncer = true
+	db = openDB()
+	defer func() {
+		db.Close()
+		db, flags.PgBouncer = saved, savedPgBouncer
+	}()
+	router := makeRouter()
+
+	send := func(method, path, body string) *http.Response {
+		req := httptest.NewRequest(method, "http://example.com"+path, bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", adminID)
+		resp, _ := fakeRequest(req, router.ServeHTTP)
+		return resp
+	}
+
+	var before int
+	err := db.QueryRow(`SELECT COUNT(*) FROM admin_audit WHERE admin_id = $1`, adminID).Scan(&before)
+	assert.Nil(t, err, "no error counting audit entries")
+
+	userID := sha256String("Xiomara")
+	resp := send("PUT", "/admin/user/"+userID+"/entitlements", `{"max_text_bytes":1024}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 setting entitlements")
+	resp = send("PUT", "/admin/user/"+userID+"/entitlements", `{}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 resetting entitlements")
+	resp = send("POST", "/admin/text/delete", `{"created_by":"`+sha256String("Nobody")+`"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 deleting texts")
+
+	var after int
+	err = db.QueryRow(`SELECT COUNT(*) FROM admin_audit WHERE admin_id = $1`, adminID).Scan(&after)
+	assert.Nil(t, err, "no error counting audit entries")
+	assert.Equal(t, before+3, after, "audited every action")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Flags are the optional features that are switched on with environment
+// variables. They're parsed once at startup, and the rest of the code looks at
+// flags rather than at the environment.
+type Flags struct {
+	// DisableCredit lets any authorized user submit as much text as they
+	// like without their credit ever being debited. This is meant for
+	// internal and test environments.
+	DisableCredit bool `json:"disable_credit"`
+	// FreeTextsPerDay is how many texts each user can submit for free each
+	// day (UTC) before we start checking and debiting their credit.
+	FreeTextsPerDay int `json:"free_texts_per_day"`
+	// SerializeUserDebits makes concurrent submissions by the same user wait
+	// on an in-process lock.
+	SerializeUserDebits bool `json:"serialize_user_debits"`
+	// AsyncInsertWorkers is the number of background workers storing texts.
+	// Zero means texts are stored before we respond.
+	AsyncInsertWorkers int `json:"async_insert_workers"`
+	// AsyncInsertQueue is how many texts can wait for a worker.
+	AsyncInsertQueue int `json:"async_insert_queue"`
+	// CanonicalJSON makes JSON responses byte-stable, with sorted keys and
+	// no HTML escaping, for clients that sign or verify response bodies.
+	CanonicalJSON bool `json:"canonical_json"`
+	// DisableIndex turns off the HTML page at /, for deployments that only
+	// serve the API.
+	DisableIndex bool `json:"disable_index"`
+	// Production marks a production deployment, where development
+	// conveniences like DevUser aren't allowed.
+	Production bool `json:"production"`
+	// DevUser is the user_id that requests without any credentials are
+	// treated as coming from.
+	DevUser string `json:"dev_user"`
+	// TrackUsage counts the bytes each user submits and reads, for cost
+	// allocation. It's off by default as it's another write per request.
+	TrackUsage bool `json:"track_usage"`
+	// ReplicaFallback retries reads that fail on the read replica against
+	// the primary, trading extra primary load for staying up during a
+	// replica outage.
+	ReplicaFallback bool `json:"replica_fallback"`
+	// Metrics serves Prometheus counters at /metrics.
+	Metrics bool `json:"metrics"`
+	// MetricsPerUser labels the credits debited counter by user, which
+	// makes one series per user.
+	MetricsPerUser bool `json:"metrics_per_user"`
+	// MoneyCredit treats credit as an amount of money with two decimal
+	// places rather than a whole number of credits. It needs the NUMERIC
+	// columns that make-schema -money creates.
+	MoneyCredit bool `json:"money_credit"`
+	// TextNotFound is how GET /text/{hash} responds when no text is stored
+	// with the hash.
+	TextNotFound string `json:"text_not_found"`
+	// ErrorFormat is how 401, 402, 404, and 500 responses describe the
+	// error.
+	ErrorFormat string `json:"error_format"`
+	// Pprof serves runtime profiles to admins under /debug/pprof/.
+	Pprof bool `json:"pprof"`
+	// PgBouncer sends each query in a single round trip, for connecting
+	// through PgBouncer in transaction pooling mode.
+	PgBouncer bool `json:"pgbouncer"`
+	// DisableKeepAlives closes every connection after one request.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+}
+
+// These are the values of TextNotFound.
+const (
+	// textNotFoundJSON is a 404 with a JSON body saying what's missing.
+	textNotFoundJSON = "404-json"
+	// textNotFoundEmpty is a 404 with no body.
+	textNotFoundEmpty = "404-empty"
+	// textNotFoundNull is a 200 with a JSON null body, for clients that
+	// treat every 404 as an error.
+	textNotFoundNull = "200-null"
+)
+
+// These are the values of ErrorFormat.
+const (
+	// errorFormatText is a plain text message, or no body at all.
+	errorFormatText = "text"
+	// errorFormatProblem is an RFC 7807 application/problem+json body.
+	errorFormatProblem = "problem"
+)
+
+var flags = defaultFlags()
+
+func defaultFlags() Flags {
+	return Flags{AsyncInsertQueue: 100, TextNotFound: textNotFoundJSON, ErrorFormat: errorFormatText}
+}
+
+func (f Flags) creditEnabled() bool {
+	return !f.DisableCredit
+}
+
+func (f Flags) freeTier() bool {
+	return f.FreeTextsPerDay > 0
+}
+
+func (f Flags) asyncInserts() bool {
+	return f.AsyncInsertWorkers > 0
+}
+
+func (f Flags) problemErrors() bool {
+	return f.ErrorFormat == errorFormatProblem
+}
+
+// parseFlags reads the flags using getenv, which is os.Getenv outside of
+// tests. Unset variables keep their default values.
+func parseFlags(getenv func(string) string) (Flags, error) {
+	f := defaultFlags()
+	f.DisableCredit = getenv("HASHTEXT_DISABLE_CREDIT") == "1"
+	f.SerializeUserDebits = getenv("HASHTEXT_SERIALIZE_USER_DEBITS") == "1"
+	f.CanonicalJSON = getenv("HASHTEXT_CANONICAL_JSON") == "1"
+	f.DisableIndex = getenv("HASHTEXT_DISABLE_INDEX") == "1"
+	f.Production = getenv("HASHTEXT_PRODUCTION") == "1"
+	f.DevUser = getenv("HASHTEXT_DEV_USER")
+	f.TrackUsage = getenv("HASHTEXT_TRACK_USAGE") == "1"
+	f.ReplicaFallback = getenv("HASHTEXT_REPLICA_FALLBACK") == "1"
+	f.Metrics = getenv("HASHTEXT_METRICS") == "1"
+	f.MetricsPerUser = getenv("HASHTEXT_METRICS_PER_USER") == "1"
+	f.MoneyCredit = getenv("HASHTEXT_MONEY_CREDIT") == "1"
+	f.Pprof = getenv("HASHTEXT_PPROF") == "1"
+	f.PgBouncer = getenv("HASHTEXT_PGBOUNCER") == "1"
+	f.DisableKeepAlives = getenv("HASHTEXT_DISABLE_KEEP_ALIVES") == "1"
+	switch nf := getenv("HASHTEXT_TEXT_NOT_FOUND"); nf {
+	case "":
+	case textNotFoundJSON, textNotFoundEmpty, textNotFoundNull:
+		f.TextNotFound = nf
+	default:
+		return Flags{}, fmt.Errorf("HASHTEXT_TEXT_NOT_FOUND must be one of %s, %s, or %s, not %q", textNotFoundJSON, textNotFoundEmpty, textNotFoundNull, nf)
+	}
+	switch ef := getenv("HASHTEXT_ERROR_FORMAT"); ef {
+	case "":
+	case errorFormatText, errorFormatProblem:
+		f.ErrorFormat = ef
+	default:
+		return Flags{}, fmt.Errorf("HASHTEXT_ERROR_FORMAT must be %s or %s, not %q", errorFormatText, errorFormatProblem, ef)
+	}
+	if f.Production && f.DevUser != "" {
+		return Flags{}, fmt.Errorf("HASHTEXT_DEV_USER cannot be set when HASHTEXT_PRODUCTION is")
+	}
+
+	for _, v := range []struct {
+		name string
+		dest *int
+		min  int
+	}{
+		{"HASHTEXT_FREE_TEXTS_PER_DAY", &f.FreeTextsPerDay, 0},
+		{"HASHTEXT_ASYNC_INSERT_WORKERS", &f.AsyncInsertWorkers, 0},
+		{"HASHTEXT_ASYNC_INSERT_QUEUE", &f.AsyncInsertQueue, 1},
+	} {
+		s := getenv(v.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < v.min {
+			return Flags{}, fmt.Errorf("%s must be an integer no smaller than %d, not %q", v.name, v.min, s)
+		}
+		*v.dest = n
+	}
+
+	return f, nil
+}
+
+func adminFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, flags)
+}
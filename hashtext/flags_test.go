@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlags(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+
+	f, err := parseFlags(getenv)
+	assert.Nil(t, err, "no error parsing an empty environment")
+	assert.Equal(t, defaultFlags(), f, "got the default flags")
+	assert.True(t, f.creditEnabled(), "credit is enabled by default")
+	assert.False(t, f.freeTier(), "there is no free tier by default")
+	assert.False(t, f.asyncInserts(), "inserts are synchronous by default")
+	assert.False(t, f.problemErrors(), "errors are plain text by default")
+
+	env = map[string]string{
+		"HASHTEXT_DISABLE_CREDIT":        "1",
+		"HASHTEXT_FREE_TEXTS_PER_DAY":    "5",
+		"HASHTEXT_SERIALIZE_USER_DEBITS": "1",
+		"HASHTEXT_ASYNC_INSERT_WORKERS":  "4",
+		"HASHTEXT_ASYNC_INSERT_QUEUE":    "50",
+		"HASHTEXT_CANONICAL_JSON":        "1",
+		"HASHTEXT_DISABLE_INDEX":         "1",
+		"HASHTEXT_TRACK_USAGE":           "1",
+		"HASHTEXT_REPLICA_FALLBACK":      "1",
+		"HASHTEXT_METRICS":               "1",
+		"HASHTEXT_METRICS_PER_USER":      "1",
+		"HASHTEXT_MONEY_CREDIT":          "1",
+		"HASHTEXT_TEXT_NOT_FOUND":        "200-null",
+		"HASHTEXT_ERROR_FORMAT":          "problem",
+		"HASHTEXT_PPROF":                 "1",
+		"HASHTEXT_PGBOUNCER":             "1",
+		"HASHTEXT_DISABLE_KEEP_ALIVES":   "1",
+	}
+	f, err = parseFlags(getenv)
+	assert.Nil(t, err, "no error parsing flags")
+	assert.Equal(t, Flags{
+		DisableCredit:       true,
+		FreeTextsPerDay:     5,
+		SerializeUserDebits: true,
+		AsyncInsertWorkers:  4,
+		AsyncInsertQueue:    50,
+		CanonicalJSON:       true,
+		DisableIndex:        true,
+		TrackUsage:          true,
+		ReplicaFallback:     true,
+		Metrics:             true,
+		MetricsPerUser:      true,
+		MoneyCredit:         true,
+		TextNotFound:        textNotFoundNull,
+		ErrorFormat:         errorFormatProblem,
+		Pprof:               true,
+		PgBouncer:           true,
+		DisableKeepAlives:   true,
+	}, f, "got the flags from the environment")
+
+	for name, value := range map[string]string{
+		"HASHTEXT_FREE_TEXTS_PER_DAY":   "-1",
+		"HASHTEXT_ASYNC_INSERT_WORKERS": "many",
+		"HASHTEXT_ASYNC_INSERT_QUEUE":   "0",
+		"HASHTEXT_TEXT_NOT_FOUND":       "410",
+		"HASHTEXT_ERROR_FORMAT":         "xml",
+	} {
+		env = map[string]string{name: value}
+		_, err = parseFlags(getenv)
+		assert.NotNil(t, err, "error parsing %s=%s", name, value)
+	}
+
+	env = map[string]string{"HASHTEXT_DEV_USER": "someone"}
+	f, err = parseFlags(getenv)
+	assert.Nil(t, err, "no error setting a dev user outside of production")
+	assert.Equal(t, "someone", f.DevUser, "got the dev user")
+
+	env["HASHTEXT_PRODUCTION"] = "1"
+	_, err = parseFlags(getenv)
+	assert.NotNil(t, err, "error setting a dev user in production")
+}
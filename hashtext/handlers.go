@@ -1,128 +1,672 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
 	"github.com/gorilla/mux"
+	"golang.org/x/sync/singleflight"
 )
 
+// wrapHandler only lets authenticated requests through to the handler. A
+// request without a valid credential gets a 401. Handlers that restrict a
+// known user from something, like wrapAdminHandler does, return a 403
+// instead. Routes in makeRouter use wrapRoute, which lets the deployment relax
+// this per route.
 func wrapHandler(
 	handler func(w http.ResponseWriter, r *http.Request),
 ) func(w http.ResponseWriter, r *http.Request) {
+	return wrapHandlerWithMode(authRequired, handler)
+}
+
+// wrapRoute wraps the handler for the named route with the auth mode
+// configured for it in routeAuth.
+func wrapRoute(
+	name string,
+	handler func(w http.ResponseWriter, r *http.Request),
+) func(w http.ResponseWriter, r *http.Request) {
+	return wrapHandlerWithMode(routeAuthMode(name), handler)
+}
+
+func wrapHandlerWithMode(
+	mode authMode,
+	handler func(w http.ResponseWriter, r *http.Request),
+) func(w http.ResponseWriter, r *http.Request) {
 
 	h := func(w http.ResponseWriter, r *http.Request) {
-		if !userIsAuthorized(r) {
-			w.WriteHeader(http.StatusUnauthorized)
+		ok, retryAfter, probe := dbBreaker.allow()
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			sendErrorMessage(w, "The service is temporarily unavailable. Please try again later.", http.StatusServiceUnavailable)
+			return
+		}
+		if !probe.IsZero() {
+			// This runs even if the handler panics, or never touches the
+			// database, so the breaker can't be left waiting for it.
+			defer dbBreaker.release(probe)
+		}
+		if mode == authNone {
+			handler(w, r)
 			return
 		}
-		handler(w, r)
+		userID, err := authenticate(r)
+		if err == errUnauthenticated && mode == authOptional {
+			handler(w, r)
+			return
+		}
+		if err != nil {
+			var ae *authError
+			switch {
+			case errors.As(err, &ae):
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description=%q`, ae.code))
+				sendErrorMessage(w, ae.code, http.StatusUnauthorized)
+			case err == errUnauthenticated:
+				sendStatus(w, http.StatusUnauthorized)
+			default:
+				// We couldn't check the credential, which doesn't make it
+				// wrong, so the client shouldn't give up on it.
+				sendErrorMessage(w, "The service is temporarily unavailable. Please try again later.", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		e, err := loadEntitlements(userID)
+		if err != nil {
+			log.Printf("Failed to load entitlements for user_id = %s: %v", userID, err)
+			sendStatus(w, http.StatusInternalServerError)
+			return
+		}
+		handler(w, withEntitlements(withUserID(r, userID), e))
 	}
 	return h
 }
 
-func userIsAuthorized(r *http.Request) bool {
-	userID := r.Header.Get("X-HashText-User-ID")
-	if userID == "" {
-		return false
+type userDocument struct {
+	UserID         string `json:"user_id"`
+	Name           string `json:"name"`
+	Credit         credit `json:"credit"`
+	Version        int64  `json:"version"`
+	NovelCount     int    `json:"novel_count"`
+	DuplicateCount int    `json:"duplicate_count"`
+}
+
+// etag starts with the user's version, which is bumped by every update to the
+// user row. Submitting a text doesn't always update the row, so the counts are
+// included too, to make sure a client polling with If-None-Match sees them
+// change.
+func (u userDocument) etag() string {
+	return fmt.Sprintf(`"%d-%d-%d"`, u.Version, u.NovelCount, u.DuplicateCount)
+}
+
+// etagVersion returns the user version an ETag from etag was made from.
+func etagVersion(etag string) (int64, error) {
+	v, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), "-")
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// etagMatches does the weak comparison If-None-Match calls for between a
+// header, which may list several ETags or be *, and our current ETag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
 	}
+	return false
+}
 
-	var found bool
-	err := db.QueryRow(`SELECT 1 FROM "user" WHERE user_id = $1`, userID).Scan(&found)
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	var u userDocument
+	err := withReadFallback(func(q *sql.DB) (err error) {
+		u, err = lookupUser(q, requestUserID(r))
+		return err
+	})
 	switch {
 	case err == sql.ErrNoRows:
-		return false
+		sendStatus(w, http.StatusNotFound)
+		return
 	case err != nil:
 		log.Printf("Query to look up user failed: %v", err)
-		return false
+		sendStatus(w, http.StatusInternalServerError)
+		return
 	}
 
-	return found
+	w.Header().Set("ETag", u.etag())
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, u.etag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	sendJSONResponse(w, u)
 }
 
-type userDocument struct {
-	UserID string `json:user_id`
-	Name   string
-	Credit int
+func lookupUser(q *sql.DB, userID string) (userDocument, error) {
+	row := q.QueryRow(
+		withTables(`SELECT name, credit, version,
+		        (SELECT COUNT(*) FROM {submission} s WHERE s.user_id = u.user_id AND NOT s.duplicate),
+		        (SELECT COUNT(*) FROM {submission} s WHERE s.user_id = u.user_id AND s.duplicate)
+		   FROM {user} u
+		  WHERE user_id = $1`),
+		userID,
+	)
+
+	u := userDocument{UserID: userID}
+	err := row.Scan(&u.Name, &u.Credit, &u.Version, &u.NovelCount, &u.DuplicateCount)
+	dbBreaker.record(err)
+	return u, err
 }
 
-func userHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("X-HashText-User-ID")
+// userReadOnlyFields are the userDocument fields that PATCH /user/me refuses
+// to change. The name is the only field a user can change.
+var userReadOnlyFields = map[string]bool{
+	"user_id":         true,
+	"credit":          true,
+	"version":         true,
+	"novel_count":     true,
+	"duplicate_count": true,
+}
 
-	row := db.QueryRow(`SELECT name, credit FROM "user" WHERE user_id = $1`, userID)
+// userPatchHandler applies a JSON Merge Patch (RFC 7386) to the user. Fields
+// left out of the patch are left alone, so {} changes nothing. A field set to
+// null would be cleared, but the name is the only field that can be patched
+// and it can't be empty. The client must send the ETag it got from GET
+// /user/me in an If-Match header, so that it can't clobber a change it hasn't
+// seen. If-Match: * matches any version, for a client that doesn't care.
+func userPatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
 
-	var name string
-	var credit int
-	err := row.Scan(&name, &credit)
-	switch {
-	case err == sql.ErrNoRows:
-		w.WriteHeader(http.StatusNotFound)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		sendErrorMessage(w, "This request requires an If-Match header", http.StatusPreconditionRequired)
 		return
-	case err != nil:
+	}
+	// A nil version matches any, as the user always exists.
+	var version *int64
+	if strings.TrimSpace(ifMatch) != "*" {
+		v, err := etagVersion(ifMatch)
+		if err != nil {
+			sendErrorMessage(w, "The user has been changed since you fetched it", http.StatusPreconditionFailed)
+			return
+		}
+		version = &v
+	}
+
+	var patch map[string]json.RawMessage
+	if !decodeJSONBody(w, r, &patch) {
+		return
+	}
+	if patch == nil {
+		sendErrorMessage(w, "The request body must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	fields := make([]string, 0, len(patch))
+	for f := range patch {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		switch {
+		case f == "name":
+		case userReadOnlyFields[f]:
+			sendErrorMessage(w, fmt.Sprintf("The %s field can't be changed", f), http.StatusBadRequest)
+			return
+		default:
+			sendErrorMessage(w, fmt.Sprintf("There is no %s field", f), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var name *string
+	if raw, ok := patch["name"]; ok {
+		if err := json.Unmarshal(raw, &name); err != nil || name == nil || *name == "" {
+			sendErrorMessage(w, "The name must be a non-empty string", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A patch that leaves the name out changes nothing, so it doesn't bump
+	// the version, but it still has to match it.
+	res, err := db.Exec(
+		withTables(`UPDATE {user}
+		    SET name = COALESCE($1::text, name),
+		        version = version + CASE WHEN $1::text IS NULL THEN 0 ELSE 1 END
+		  WHERE user_id = $2 AND ($3::bigint IS NULL OR version = $3)`),
+		name, userID, version,
+	)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to update user with user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		sendErrorMessage(w, "The user has been changed since you fetched it", http.StatusPreconditionFailed)
+		return
+	}
+
+	u, err := lookupUser(db, userID)
+	if err != nil {
 		log.Printf("Query to look up user failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", u.etag())
+	sendJSONResponse(w, u)
+}
+
+type userHashDocument struct {
+	Hash      string   `json:"hash"`
+	CreatedAt jsonTime `json:"created_at"`
+}
+
+// userHashListDocument is one page of a user's hashes. NextOffset is the
+// offset of the next page, or null if this is the last one. Truncated is set
+// when maxPageBytes cut the page short of the limit.
+type userHashListDocument struct {
+	Hashes     []userHashDocument `json:"hashes"`
+	NextOffset *int               `json:"next_offset"`
+	Truncated  bool               `json:"truncated"`
+}
+
+// userHashesHandler lists the hashes of the texts the user stored, oldest
+// first, so that a client can sync them without fetching every text. Texts
+// the user submitted after someone else had already stored them aren't
+// listed, as they belong to whoever stored them first.
+func userHashesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	limit, offset, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	// We fetch one extra row to find out whether there's another page.
+	var rows *sql.Rows
+	err := withReadFallback(func(q *sql.DB) (err error) {
+		rows, err = q.Query(
+			withTables(`SELECT hash, created_at FROM {hash_text}
+			  WHERE created_by = $1
+			  ORDER BY created_at, hash
+			  LIMIT $2 OFFSET $3`),
+			userID, limit+1, offset,
+		)
+		return err
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to list hashes for user_id = %s failed: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	ld := userHashListDocument{Hashes: []userHashDocument{}}
+	for rows.Next() {
+		var hd userHashDocument
+		if err := rows.Scan(&hd.Hash, &hd.CreatedAt); err != nil {
+			log.Printf("Failed to scan a hash: %v", err)
+			sendStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ld.Hashes = append(ld.Hashes, hd)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list hashes for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
 		return
 	}
 
-	sendJSONResponse(w, userDocument{UserID: userID, Name: name, Credit: credit})
+	ld.Hashes, ld.NextOffset, ld.Truncated = trimPage(ld.Hashes, limit, offset)
+	sendJSONResponse(w, ld)
 }
 
+// submittedText is the JSON body of a submitted text.
+type submittedText struct {
+	Text string `json:"text"`
+}
+
+// textDocument is what we return for a stored text. Length (in bytes) and
+// RuneCount let clients size a preview without measuring it themselves, and
+// are sent even when they're zero.
 type textDocument struct {
-	Text string "json:text"
+	Text      string `json:"text"`
+	Length    int    `json:"length"`
+	RuneCount int    `json:"rune_count"`
+	// Hash and HashMatches are only set when the client asks for them with
+	// with_hash=1. Hash is recomputed from the stored text, so HashMatches is
+	// false if the text has been corrupted since it was stored.
+	Hash        string `json:"hash,omitempty"`
+	HashMatches *bool  `json:"hash_matches,omitempty"`
+}
+
+func newTextDocument(text string) textDocument {
+	return textDocument{Text: text, Length: len(text), RuneCount: utf8.RuneCountInString(text)}
 }
 
+// hashDocument is the response to a submitted text. Pending is set when the
+// text was queued for an async insert, and so can't be read back yet.
+// Algorithm is only sent by the endpoints that take ?algo=.
 type hashDocument struct {
-	Hash string "json:hash"
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Pending   bool   `json:"pending,omitempty"`
 }
 
 func textHandler(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("X-HashText-User-ID")
-	if !userHasCredit(userID) {
-		sendErrorMessage(w, "You are out of credit. Please pay us more money.", http.StatusPaymentRequired)
+	userID := requestUserID(r)
+	if !hasMinCredit(w, r) {
 		return
 	}
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Failed to read the request body: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !withinFreeQuota(userID) && !userHasCredit(userID) {
+		sendOutOfCredit(w)
 		return
 	}
 
-	var td textDocument
-	if err := json.Unmarshal(body, &td); err != nil {
-		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+	text, hash, ok := readSubmittedText(w, r)
+	if !ok {
 		return
 	}
+	quota := requestEntitlements(r).userByteQuota()
 
 	// This will work with an empty string, for some value of work. If we
 	// wanted to make this a bit smarter, we'd check the length of the text
 	// submitted and return an error if it's empty.
 	//
-	// In a production application we might want to do the insert in a
-	// goroutine, but this makes testing much more complicated.
-	hash := sha256String(td.Text)
-	insertText(td.Text, hash, userID)
+	// When async inserts are turned on, the text is written and paid for by
+	// a worker after we respond, so we can't report a hash collision or the
+	// cost to the client. That's also why it's off by default, as it makes
+	// testing much more complicated.
+	if inserts != nil {
+		// The worker enforces the quota, but by then we can't tell the
+		// client, so we check what we can now.
+		if !withinStorageQuota(w, r, text, hash) {
+			return
+		}
+		if !inserts.enqueue(insertJob{text: text, hash: hash, userID: userID, quota: quota}) {
+			sendErrorMessage(w, "Too many texts are waiting to be stored. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+		recordUsage(userID, int64(len(text)), 0)
+		// The text isn't stored yet, so we point the client at where it
+		// will be rather than claiming it's already there.
+		w.Header().Set("Location", "/text/"+hash)
+		sendJSONResponseWithStatus(w, http.StatusAccepted, hashDocument{Hash: hash, Pending: true})
+		return
+	}
+
+	debited, err := insertText(r.Context(), text, hash, userID, quota)
+	var overQuota *hashstore.QuotaError
+	switch {
+	case err == errOutOfCredit:
+		sendOutOfCredit(w)
+		return
+	case err == hashstore.ErrHashCollision:
+		sendErrorMessage(w, "A different text is already stored with this hash", http.StatusConflict)
+		return
+	case errors.As(err, &overQuota):
+		sendOverQuota(w, overQuota)
+		return
+	case err != nil:
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	recordUsage(userID, int64(len(text)), 0)
+	w.Header().Set("X-HashText-Credit-Cost", debited.cost.String())
+	w.Header().Set("X-HashText-Credit-Remaining", debited.remaining.String())
 	sendJSONResponse(w, hashDocument{Hash: hash})
 }
 
+func sendOutOfCredit(w http.ResponseWriter) {
+	paymentRequired.add("", 1)
+	sendErrorMessage(w, "You are out of credit. Please pay us more money.", http.StatusPaymentRequired)
+}
+
+// readSubmittedText returns the text a client is submitting along with its
+// hash. A text/plain body is the text itself, which we hash as it's read. A
+// multipart/form-data body must have exactly one part named text, which is
+// treated the same way. Anything else is expected to be a JSON submittedText.
+// If ok is false an error response has already been sent.
+func readSubmittedText(w http.ResponseWriter, r *http.Request) (text, hash string, ok bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/plain":
+		return readAndHash(w, r, http.MaxBytesReader(w, r.Body, requestEntitlements(r).maxTextBytes()))
+	case "multipart/form-data":
+		return readMultipartText(w, r)
+	}
+
+	var st submittedText
+	if !decodeJSONBody(w, r, &st) {
+		return "", "", false
+	}
+	return st.Text, hashText(st.Text), true
+}
+
+// readMultipartText reads the text part of a multipart/form-data body. The
+// size limit applies to the whole body, including the multipart framing and
+// any other parts, which we skip.
+func readMultipartText(w http.ResponseWriter, r *http.Request) (text, hash string, ok bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, requestEntitlements(r).maxTextBytes())
+	mr, err := r.MultipartReader()
+	if err != nil {
+		sendErrorMessage(w, "Could not read the request body as multipart/form-data", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	found := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				sendBodyTooLarge(w, r)
+				return "", "", false
+			}
+			sendErrorMessage(w, "Could not read the request body as multipart/form-data", http.StatusBadRequest)
+			return "", "", false
+		}
+		if part.FormName() != "text" {
+			continue
+		}
+		if found {
+			sendErrorMessage(w, "The request body must have only one text part", http.StatusBadRequest)
+			return "", "", false
+		}
+		found = true
+		text, hash, ok = readAndHash(w, r, part)
+		if !ok {
+			return "", "", false
+		}
+	}
+
+	if !found {
+		sendErrorMessage(w, "The request body must have a text part", http.StatusBadRequest)
+		return "", "", false
+	}
+	return text, hash, true
+}
+
+// readAndHash reads all of rd, which is r's body or part of it, hashing it as
+// it goes. rd should already be limited to the user's max text size. The text
+// must be valid UTF-8, since that's all the hash_text column can hold. JSON
+// bodies don't need this check, as the decoder replaces invalid bytes with
+// U+FFFD.
+func readAndHash(w http.ResponseWriter, r *http.Request, rd io.Reader) (text, hash string, ok bool) {
+	h := sha256.New()
+	var b strings.Builder
+	_, err := io.Copy(&b, io.TeeReader(rd, h))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendBodyTooLarge(w, r)
+			return "", "", false
+		}
+		var badGzip *gzipError
+		if errors.As(err, &badGzip) {
+			sendErrorMessage(w, "Could not decompress the gzip request body", http.StatusBadRequest)
+			return "", "", false
+		}
+		log.Printf("Failed to read the request body: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return "", "", false
+	}
+	if !utf8.ValidString(b.String()) {
+		sendErrorMessage(w, "The text must be valid UTF-8", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return b.String(), textDigest.Encode(h.Sum(nil)), true
+}
+
+// hashHandler returns the hash for a text without storing it. It doesn't
+// touch the database, so it needs neither authorization nor credit. As
+// nothing is stored, the client can pick the algorithm.
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	algorithm, newHash, ok := algorithmParam(w, r)
+	if !ok {
+		return
+	}
+	var td struct {
+		Text *string `json:"text"`
+	}
+	if !decodeJSONBody(w, r, &td) {
+		return
+	}
+	if td.Text == nil {
+		sendErrorMessage(w, "The request body must have a text key", http.StatusBadRequest)
+		return
+	}
+
+	hash, _ := hashReader(newHash, strings.NewReader(*td.Text))
+	sendJSONResponse(w, hashDocument{Hash: hash, Algorithm: algorithm})
+}
+
+// hashStreamHandler returns the hash of the raw request body, hashing it as
+// it's read so that files too large to submit as a text can still be hashed.
+// Like hashHandler it stores nothing and needs neither authorization nor
+// credit.
+func hashStreamHandler(w http.ResponseWriter, r *http.Request) {
+	algorithm, newHash, ok := algorithmParam(w, r)
+	if !ok {
+		return
+	}
+	if r.ContentLength > maxStreamBytes {
+		sendStreamTooLarge(w)
+		return
+	}
+	hash, err := hashReader(newHash, http.MaxBytesReader(w, r.Body, maxStreamBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendStreamTooLarge(w)
+			return
+		}
+		sendErrorMessage(w, "Could not read the request body", http.StatusBadRequest)
+		return
+	}
+
+	sendJSONResponse(w, hashDocument{Hash: hash, Algorithm: algorithm})
+}
+
+func sendStreamTooLarge(w http.ResponseWriter) {
+	sendErrorMessage(w, fmt.Sprintf("The request body cannot be larger than %d bytes", maxStreamBytes), http.StatusRequestEntityTooLarge)
+}
+
+type verifyDocument struct {
+	Matches bool `json:"matches"`
+	Stored  bool `json:"stored"`
+}
+
+// textVerifyHandler tells the client whether a text they have hashes to the
+// hash in the URL, and whether we have a text stored under that hash. It
+// doesn't store anything, so it's free.
+func textVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	var td struct {
+		Text *string `json:"text"`
+	}
+	if !decodeJSONBody(w, r, &td) {
+		return
+	}
+	if td.Text == nil {
+		sendErrorMessage(w, "The request body must have a text key", http.StatusBadRequest)
+		return
+	}
+
+	vd := verifyDocument{Matches: hashText(*td.Text) == hash}
+	err := withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(withTables(`SELECT true FROM {hash_text} WHERE hash = $1`), hash).Scan(&vd.Stored)
+	})
+	dbBreaker.record(err)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Query to look up text by hash failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, vd)
+}
+
+// decodeJSONBody decodes the request body into v straight from the
+// connection, without first buffering the raw body, and enforces the
+// user's max text size while doing so. If it returns false it has already sent
+// an error response.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, requestEntitlements(r).maxTextBytes())).Decode(v)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendBodyTooLarge(w, r)
+			return false
+		}
+		sendErrorMessage(w, "Could not decode the request body as JSON", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func sendBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	sendErrorMessage(w, fmt.Sprintf("The request body cannot be larger than %d bytes", requestEntitlements(r).maxTextBytes()), http.StatusRequestEntityTooLarge)
+}
+
 func sha256String(s string) string {
 	h := sha256.New()
-	h.Write([]byte(s))
+	io.WriteString(h, s)
 	return hex.EncodeToString(h.Sum(nil))
 }
 
 func userHasCredit(userID string) bool {
-	row := db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID)
+	if !flags.creditEnabled() {
+		return true
+	}
+
+	row := db.QueryRow(withTables(`SELECT credit FROM {user} WHERE user_id = $1`), userID)
 
-	var credit int
-	err := row.Scan(&credit)
+	var balance credit
+	err := row.Scan(&balance)
+	dbBreaker.record(err)
 	if err != nil {
 		log.Printf("Query to look up user failed: %v", err)
 		// We might want to return a 500 here but this code is getting
@@ -130,61 +674,608 @@ func userHasCredit(userID string) bool {
 		return false
 	}
 
-	return credit > 0
+	return balance >= textPrice
 }
 
-func insertText(text, hash, userID string) {
-	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2) ON CONFLICT DO NOTHING", hash, text)
+// minCreditHeader lets a client refuse to spend credit unless the user has at
+// least this much, even if the request itself would cost less, as a safety
+// margin of its own.
+const minCreditHeader = "X-HashText-Min-Credit"
+
+// hasMinCredit checks the user's balance against minCreditHeader before a
+// request does any work. It sends the response and returns false if the header
+// is invalid or the balance is below it. With credit disabled nothing is ever
+// charged, so the header is ignored.
+func hasMinCredit(w http.ResponseWriter, r *http.Request) bool {
+	h := r.Header.Get(minCreditHeader)
+	if h == "" || !flags.creditEnabled() {
+		return true
+	}
+	min, err := parseCredit(h)
+	if err != nil || min < 0 {
+		sendErrorMessage(w, "The "+minCreditHeader+" header must be a non-negative amount of credit", http.StatusBadRequest)
+		return false
+	}
+
+	userID := requestUserID(r)
+	var balance credit
+	err = db.QueryRowContext(r.Context(), withTables(`SELECT credit FROM {user} WHERE user_id = $1`), userID).Scan(&balance)
+	dbBreaker.recordContext(r.Context(), err)
 	if err != nil {
-		log.Printf("Failed to insert text with hash = %s: %v", hash, err)
-		return
+		log.Printf("Query to look up user failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return false
 	}
+	if balance < min {
+		paymentRequired.add("", 1)
+		sendErrorMessage(w, fmt.Sprintf("You have less than the %s credit this request requires.", min), http.StatusPaymentRequired)
+		return false
+	}
+	return true
+}
 
-	_, err = db.Exec(`UPDATE "user" SET credit = GREATEST(0, credit - 1) WHERE user_id = $1`, userID)
+// errOutOfCredit is returned by insertText when the user can't pay for a new
+// text, usually because a concurrent submission spent their last credit or
+// their last free text first.
+var errOutOfCredit = errors.New("the user is out of credit")
+
+// withinFreeQuota returns true if the user hasn't yet used up today's free
+// submissions. Days start at midnight UTC. It's a preview, used to turn away
+// a user who can't pay early. insertText makes the real decision.
+func withinFreeQuota(userID string) bool {
+	if !flags.freeTier() {
+		return false
+	}
+
+	n, err := submissionsToday(userID)
 	if err != nil {
-		log.Printf("Failed to debit user with user_id = %s: %v", userID, err)
-		return
+		log.Printf("Query to count submissions failed: %v", err)
+		return false
+	}
+
+	return n < flags.FreeTextsPerDay
+}
+
+// withinStorageQuota returns true if storing the text wouldn't take the user
+// over their byte quota. A text that's already stored doesn't use any more
+// space, so it's always allowed. If it returns false it has already sent an
+// error response.
+//
+// This is only a preview, for when we can't wait for storeText, which is what
+// enforces the quota. A concurrent submission can use the space before we do.
+func withinStorageQuota(w http.ResponseWriter, r *http.Request, text, hash string) bool {
+	userID := requestUserID(r)
+	quota := requestEntitlements(r).userByteQuota()
+	if quota <= 0 {
+		return true
+	}
+
+	var stored int64
+	var exists bool
+	err := db.QueryRow(
+		withTables(`SELECT stored_bytes, EXISTS (SELECT 1 FROM {hash_text} WHERE hash = $2)
+		   FROM {user} WHERE user_id = $1`),
+		userID, hash,
+	).Scan(&stored, &exists)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to look up stored bytes failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return false
+	}
+
+	if exists || stored+int64(len(text)) <= quota {
+		return true
+	}
+	sendOverQuota(w, &hashstore.QuotaError{Stored: stored, Quota: quota})
+	return false
+}
+
+func sendOverQuota(w http.ResponseWriter, e *hashstore.QuotaError) {
+	sendErrorMessage(
+		w,
+		fmt.Sprintf("Storing this text would take you over your storage quota. You are using %d of %d bytes.", e.Stored, e.Quota),
+		http.StatusInsufficientStorage,
+	)
+}
+
+func submissionsToday(userID string) (int, error) {
+	return countSubmissionsToday(context.Background(), db, userID)
+}
+
+func countSubmissionsToday(ctx context.Context, q querier, userID string) (int, error) {
+	var n int
+	err := q.QueryRowContext(
+		ctx,
+		withTables(`SELECT COUNT(*) FROM {submission}
+		  WHERE user_id = $1
+		    AND created_at >= date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'`),
+		userID,
+	).Scan(&n)
+	dbBreaker.recordContext(ctx, err)
+	return n, err
+}
+
+// freeSubmission reports whether the submission being recorded in tx is one
+// of the user's free texts for the day. withinFreeQuota can only guess this,
+// as concurrent submissions see the same count. Here we lock the user's row
+// first, so the user's submissions take turns, and each one counts the
+// submissions committed before it.
+func freeSubmission(ctx context.Context, tx *sql.Tx, userID string) (bool, error) {
+	if !flags.freeTier() {
+		return false, nil
+	}
+
+	_, err := tx.ExecContext(ctx, withTables(`SELECT 1 FROM {user} WHERE user_id = $1 FOR UPDATE`), userID)
+	dbBreaker.recordContext(ctx, err)
+	if err != nil {
+		log.Printf("Failed to lock user with user_id = %s: %v", userID, err)
+		return false, err
+	}
+	n, err := countSubmissionsToday(ctx, tx, userID)
+	if err != nil {
+		log.Printf("Query to count submissions failed: %v", err)
+		return false, err
+	}
+	return n < flags.FreeTextsPerDay, nil
+}
+
+// debit says how much credit a submission cost and what the user had left
+// afterwards.
+type debit struct {
+	cost      credit
+	remaining credit
+}
+
+// A querier is a *sql.DB or a *sql.Tx, so that the same queries can run on
+// their own or as part of a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// insertText stores the text and records the submission. The user's credit is
+// only debited when this submission is the one that stored the text and it
+// isn't one of the user's free texts for the day. Resubmitting a text that's
+// already stored is free. If the user can't pay, it returns errOutOfCredit.
+//
+// It's all one transaction, so we never store a text without charging for it,
+// and a free text is counted in the same transaction that makes it free.
+// If ctx is cancelled, say because the client went away, database/sql rolls
+// the transaction back straight away, which releases the locks it holds on
+// the user's row and on the hash.
+func insertText(ctx context.Context, text, hash, userID string, quota int64) (debit, error) {
+	// The transaction locks the user's row before it debits them, when it
+	// locks it for the free tier or counts the text's bytes. So the per-user
+	// lock has to be taken before the transaction begins, or the requests
+	// would already be queued on the row lock by the time they got here.
+	debitLocks.lock(userID)
+	defer debitLocks.unlock(userID)
+
+	var d debit
+	err := withTx(ctx, func(tx *sql.Tx) error {
+		free, err := freeSubmission(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		novel, err := storeText(ctx, tx, text, hash, userID, quota)
+		if err != nil {
+			return err
+		}
+		charge := novel && !free
+		d, err = debitCredit(ctx, tx, userID, charge)
+		if err == nil && charge && flags.creditEnabled() && d.cost == 0 {
+			return errOutOfCredit
+		}
+		return err
+	})
+	if err != nil {
+		return debit{}, err
+	}
+	return d, nil
+}
+
+// storeText stores the text and records the submission with
+// hashstore.StoreText, and counts the result. It returns true if this call
+// stored the text.
+func storeText(ctx context.Context, q querier, text, hash, userID string, quota int64) (bool, error) {
+	novel, err := hashstore.StoreText(ctx, q, tableReplacer, text, hash, userID, quota)
+	var overQuota *hashstore.QuotaError
+	switch {
+	case err == hashstore.ErrHashCollision:
+		// The queries worked, so this isn't a reason to open the breaker.
+		dbBreaker.recordContext(ctx, nil)
+		log.Printf("Hash collision: a different text is already stored with hash = %s", hash)
+		return false, err
+	case errors.As(err, &overQuota):
+		dbBreaker.recordContext(ctx, nil)
+		return false, err
+	case err != nil:
+		dbBreaker.recordContext(ctx, err)
+		log.Printf("Failed to store text with hash = %s by user_id = %s: %v", hash, userID, err)
+		return false, err
+	}
+	dbBreaker.recordContext(ctx, nil)
+
+	switch {
+	case inSelftest(ctx):
+		// The self-test always rolls its text back.
+	case novel:
+		textsStored.add("", 1)
+	default:
+		textsDuplicate.add("", 1)
+	}
+	return novel, nil
+}
+
+// debitCredit charges the user for a submission when charge is true.
+func debitCredit(ctx context.Context, q querier, userID string, charge bool) (debit, error) {
+	if charge && flags.creditEnabled() {
+		// The user may have run out of credit since we checked, in which
+		// case no row is updated and the cost is zero. It's up to the
+		// caller whether that's an error.
+		var remaining credit
+		err := q.QueryRowContext(
+			ctx,
+			withTables(`UPDATE {user} SET credit = credit - $2, version = version + 1 WHERE user_id = $1 AND credit >= $2 RETURNING credit`),
+			userID, textPrice,
+		).Scan(&remaining)
+		dbBreaker.recordContext(ctx, err)
+		switch {
+		case err == nil:
+			if !inSelftest(ctx) {
+				creditsDebited.add(metricsUser(userID), int64(textPrice))
+			}
+			return debit{cost: textPrice, remaining: remaining}, nil
+		case err != sql.ErrNoRows:
+			log.Printf("Failed to debit user with user_id = %s: %v", userID, err)
+			return debit{}, err
+		}
+	}
+
+	var remaining credit
+	err := q.QueryRowContext(ctx, withTables(`SELECT credit FROM {user} WHERE user_id = $1`), userID).Scan(&remaining)
+	dbBreaker.recordContext(ctx, err)
+	if err != nil {
+		log.Printf("Query to look up user failed: %v", err)
+		return debit{}, err
 	}
+	return debit{cost: 0, remaining: remaining}, nil
 }
 
 func textHashHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	row := db.QueryRow(`SELECT text FROM hash_text WHERE hash = $1`, vars["hash"])
+	withHash, ok := boolParam(w, r, "with_hash")
+	if !ok {
+		return
+	}
+	text, ok := readText(w, vars["hash"])
+	if !ok {
+		return
+	}
+	recordUsage(requestUserID(r), 0, int64(len(text)))
 
-	var text string
-	err := row.Scan(&text)
+	var rehashed string
+	var matches bool
+	if withHash {
+		rehashed = hashText(text)
+		matches = rehashed == vars["hash"]
+		if !matches {
+			log.Printf("The text stored with hash = %s now hashes to %s, so it may be corrupt", vars["hash"], rehashed)
+		}
+	}
+
+	if acceptsPlainText(r) {
+		if withHash {
+			w.Header().Set("X-HashText-Hash", rehashed)
+			w.Header().Set("X-HashText-Hash-Matches", strconv.FormatBool(matches))
+		}
+		sendTextRange(w, r, text)
+		return
+	}
+	td := newTextDocument(text)
+	if withHash {
+		td.Hash = rehashed
+		td.HashMatches = &matches
+	}
+	sendJSONResponse(w, td)
+}
+
+// textLookups shares one query between concurrent readText calls for the
+// same hash, so that a burst of requests for a popular text only costs one
+// trip to the database.
+var textLookups singleflight.Group
+
+// lookupText is the query behind readText. It's a variable so that tests can
+// count the queries.
+var lookupText = func(hash string) (text string, lastAccessed sql.NullTime, err error) {
+	err = withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(withTables(`SELECT text, last_accessed_at FROM {hash_text} WHERE hash = $1`), hash).
+			Scan(&text, &lastAccessed)
+	})
+	dbBreaker.record(err)
+	return text, lastAccessed, err
+}
+
+// readText looks up the text stored with hash, and notes that it was read. If
+// ok is false it has already sent an error response.
+func readText(w http.ResponseWriter, hash string) (text string, ok bool) {
+	v, err, _ := textLookups.Do(hash, func() (interface{}, error) {
+		text, lastAccessed, err := lookupText(hash)
+		if err != nil {
+			return nil, err
+		}
+		// Only the request that made the query touches the text.
+		if !lastAccessed.Valid || time.Since(lastAccessed.Time) > lastAccessedResolution {
+			touchText(hash)
+		}
+		return text, nil
+	})
 	switch {
 	case err == sql.ErrNoRows:
-		w.WriteHeader(http.StatusNotFound)
-		return
+		sendTextNotFound(w, hash)
+		return "", false
 	case err != nil:
 		log.Printf("Query to look up text by hash failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		sendStatus(w, http.StatusInternalServerError)
+		return "", false
+	}
+	return v.(string), true
+}
+
+// textNotFoundDocument is the body of a 404 for a text with textNotFoundJSON.
+type textNotFoundDocument struct {
+	Error string `json:"error"`
+	Hash  string `json:"hash"`
+}
+
+// sendTextNotFound tells the client that no text is stored with the hash, in
+// whichever way HASHTEXT_TEXT_NOT_FOUND asks for.
+func sendTextNotFound(w http.ResponseWriter, hash string) {
+	switch flags.TextNotFound {
+	case textNotFoundEmpty:
+		w.WriteHeader(http.StatusNotFound)
+	case textNotFoundNull:
+		sendJSONResponse(w, nil)
+	default:
+		if flags.problemErrors() {
+			sendProblem(w, http.StatusNotFound, http.StatusText(http.StatusNotFound), "No text is stored with this hash")
+			return
+		}
+		sendJSONResponseWithStatus(w, http.StatusNotFound, textNotFoundDocument{
+			Error: "No text is stored with this hash",
+			Hash:  hash,
+		})
+	}
+}
+
+// acceptsPlainText returns true when the Accept header prefers text/plain to
+// JSON. JSON stays the default for a missing header, application/json, or a
+// wildcard.
+func acceptsPlainText(r *http.Request) bool {
+	return prefersOverJSON(r, "text/plain")
+}
+
+// acceptsNDJSON is like acceptsPlainText, but for newline-delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	return prefersOverJSON(r, "application/x-ndjson")
+}
+
+// prefersOverJSON returns true when the Accept header gives alternative a
+// higher q-value than JSON. Each gets the q-value of the most specific media
+// range that matches it, and q=0 means it isn't acceptable at all. When they
+// tie, whichever's range comes first in the header wins, so "*/*" alone
+// still means JSON.
+func prefersOverJSON(r *http.Request, alternative string) bool {
+	accept := r.Header.Get("Accept")
+	altQ, altIndex := acceptQuality(accept, alternative)
+	jsonQ, jsonIndex := acceptQuality(accept, "application/json")
+	if altQ == 0 {
+		return false
+	}
+	if altQ != jsonQ {
+		return altQ > jsonQ
 	}
+	return altIndex < jsonIndex
+}
+
+// acceptQuality returns the q-value the Accept header gives mediaType, and
+// the position of the media range it came from. A media type the header
+// doesn't match has a q-value of 0. Ranges with an invalid q-value are
+// ignored.
+func acceptQuality(accept, mediaType string) (q float64, index int) {
+	typeWildcard := strings.SplitN(mediaType, "/", 2)[0] + "/*"
+	best := -1
+	for i, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var specificity int
+		switch mt {
+		case mediaType:
+			specificity = 2
+		case typeWildcard:
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity <= best {
+			continue
+		}
 
-	sendJSONResponse(w, textDocument{Text: text})
+		rangeQ := 1.0
+		if v, ok := params["q"]; ok {
+			rangeQ, err = strconv.ParseFloat(v, 64)
+			if err != nil || rangeQ < 0 || rangeQ > 1 {
+				continue
+			}
+		}
+		best, q, index = specificity, rangeQ, i
+	}
+	return q, index
+}
+
+// We only record when a text was last read to within an hour. There's no
+// point in turning every read into a write.
+const lastAccessedResolution = time.Hour
+
+// accessUpdates lets tests wait for touchText to finish.
+var accessUpdates sync.WaitGroup
+
+// touchText updates the text's last_accessed_at in the background so that it
+// doesn't slow down the read.
+func touchText(hash string) {
+	accessUpdates.Add(1)
+	go func() {
+		defer accessUpdates.Done()
+		_, err := db.Exec(
+			withTables(`UPDATE {hash_text} SET last_accessed_at = now()
+			  WHERE hash = $1
+			    AND (last_accessed_at IS NULL OR last_accessed_at < now() - $2 * interval '1 second')`),
+			hash, lastAccessedResolution.Seconds(),
+		)
+		dbBreaker.record(err)
+		if err != nil {
+			log.Printf("Failed to update last_accessed_at for hash = %s: %v", hash, err)
+		}
+	}()
 }
 
 func sendErrorMessage(w http.ResponseWriter, msg string, status int) {
+	if flags.problemErrors() && problemStatuses[status] {
+		sendProblem(w, status, http.StatusText(status), msg)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 	w.WriteHeader(status)
 	io.WriteString(w, msg)
 }
 
+func sendTextResponse(w http.ResponseWriter, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := io.WriteString(w, text)
+	if err != nil {
+		log.Printf("Failed to write the response body: %v", err)
+		return
+	}
+}
+
+// sendTextRange is sendTextResponse for a client that may only want part of
+// the text. A Range header gets a 206 with just those bytes, or a 416 if none
+// of them are in the text, and a request without one gets the whole text.
+// Ranges are in bytes, so a range can start or end in the middle of a UTF-8
+// character.
+func sendTextRange(w http.ResponseWriter, r *http.Request, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	// ServeContent sets Accept-Ranges and handles HEAD. With no name or
+	// modification time it leaves the Content-Type we set alone, and never
+	// answers with a 304.
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(text))
+}
+
 func sendJSONResponse(w http.ResponseWriter, data interface{}) {
+	sendJSONResponseWithStatus(w, http.StatusOK, data)
+}
+
+func sendJSONResponseWithStatus(w http.ResponseWriter, status int, data interface{}) {
+	writeJSON(w, status, "application/json; charset=UTF-8", data)
+}
+
+// encodeJSON encodes data the way every JSON response is encoded, with the
+// service notice and, if it's turned on, as canonical JSON.
+func encodeJSON(data interface{}) ([]byte, error) {
 	body, err := json.Marshal(data)
+	if err == nil && serviceNotice != "" {
+		body, err = addNotice(body)
+	}
+	if err == nil && flags.CanonicalJSON {
+		body, err = canonicalJSON(body)
+	}
+	return body, err
+}
+
+// writeJSON encodes data with encodeJSON, and sends it with the given
+// Content-Type.
+func writeJSON(w http.ResponseWriter, status int, contentType string, data interface{}) {
+	body, err := encodeJSON(data)
 	if err != nil {
 		log.Printf("Failed to encode a JSON response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		sendEncodeError(w)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
 	_, err = w.Write(body)
 	if err != nil {
 		log.Printf("Failed to write the response body: %v", err)
 		return
 	}
 }
+
+// These are the bodies sendEncodeError sends. They're written out by hand so
+// that sending them can't fail the way encoding the response did.
+const (
+	encodeErrorJSON    = `{"error":"Internal server error"}`
+	encodeErrorProblem = `{"type":"about:blank","title":"Internal Server Error","status":500}`
+)
+
+// sendEncodeError sends a 500 with a small JSON body in place of a response
+// that writeJSON couldn't encode. Nothing has been written yet at that point,
+// so the client gets a complete 500 rather than part of the response that
+// failed.
+func sendEncodeError(w http.ResponseWriter) {
+	contentType, body := "application/json; charset=UTF-8", encodeErrorJSON
+	if flags.problemErrors() {
+		contentType, body = "application/problem+json; charset=UTF-8", encodeErrorProblem
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusInternalServerError)
+	if _, err := io.WriteString(w, body); err != nil {
+		log.Printf("Failed to write the response body: %v", err)
+	}
+}
+
+// canonicalJSON re-encodes raw with its object keys sorted and without
+// escaping <, >, and & as json.Marshal does, so that anyone re-encoding the
+// same values this way gets exactly the same bytes. json.Marshal encodes
+// struct fields in declaration order, so we round trip through a generic
+// value, which json sorts by key. The result has a trailing newline.
+func canonicalJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(generic); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// addNotice adds the service notice to a JSON object as its first key. Any
+// other JSON value is left alone.
+func addNotice(body []byte) ([]byte, error) {
+	if len(body) == 0 || body[0] != '{' {
+		return body, nil
+	}
+	notice, err := json.Marshal(serviceNotice)
+	if err != nil {
+		return nil, err
+	}
+
+	b := append([]byte(`{"notice":`), notice...)
+	if string(body) != "{}" {
+		b = append(b, ',')
+	}
+	return append(b, body[1:]...), nil
+}
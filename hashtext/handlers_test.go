@@ -2,17 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
 )
 
 func TestMain(m *testing.M) {
@@ -24,20 +33,29 @@ var testDB *sql.DB
 
 func setupFixtures() {
 	os.Setenv("HASHTEXT_DB", "hashtext_test")
+	// The tests can be run with HASHTEXT_PGBOUNCER set, to check that every
+	// query works with binary_parameters.
+	flags.PgBouncer = os.Getenv("HASHTEXT_PGBOUNCER") == "1"
 	// This has the gross side effect of also setting the global db var in
 	// main.go which in turn is used in handlers.go. In a real application,
 	// we'd want to wrap up our handlers in a struct that contained a *sql.DB,
 	// and possible even go further and create these handlers using dependency
 	// injection.
 	db = openDB()
-	execWithCheck(db, `DELETE FROM "user"`)
+	readDB = db
+	execWithCheck(db, `DELETE FROM submission`)
+	execWithCheck(db, `DELETE FROM api_key`)
+	execWithCheck(db, `DELETE FROM credit_hold`)
+	execWithCheck(db, `DELETE FROM user_usage`)
+	execWithCheck(db, `DELETE FROM admin_audit`)
 	execWithCheck(db, `DELETE FROM "hash_text"`)
+	execWithCheck(db, `DELETE FROM "user"`)
 	populateTables(db)
 }
 
 type User struct {
 	name   string
-	credit int
+	credit int64
 }
 
 func populateTables(db *sql.DB) {
@@ -60,38 +78,54 @@ func execWithCheck(db *sql.DB, s string, args ...interface{}) {
 	}
 }
 
-func TestUserIsAuthorized(t *testing.T) {
+func TestAuthenticate(t *testing.T) {
 	r := httptest.NewRequest("GET", "http://example.com/", nil)
-	assert.False(t, userIsAuthorized(r), "returns false when there is no X-HashText-User-ID header")
+	_, err := authenticate(r)
+	assert.NotNil(t, err, "returns an error when there is no X-HashText-User-ID header")
 
 	r.Header.Set("X-HashText-User-ID", "")
-	assert.False(t, userIsAuthorized(r), "returns false when the X-HashText-User-ID header is empty")
+	_, err = authenticate(r)
+	assert.NotNil(t, err, "returns an error when the X-HashText-User-ID header is empty")
 
 	r.Header.Set("X-HashText-User-ID", "0")
-	assert.False(t, userIsAuthorized(r), "returns false when the X-HashText-User-ID header is 0")
+	_, err = authenticate(r)
+	assert.NotNil(t, err, "returns an error when the X-HashText-User-ID header is 0")
 
 	r.Header.Set("X-HashText-User-ID", "foo")
-	assert.False(t, userIsAuthorized(r), "returns false when the X-HashText-User-ID header is foo")
+	_, err = authenticate(r)
+	assert.NotNil(t, err, "returns an error when the X-HashText-User-ID header is foo")
 
 	r.Header.Set("X-HashText-User-ID", sha256String("Jane"))
-	assert.True(t, userIsAuthorized(r), "returns true when the X-HashText-User-ID header is the SHA256 hash for Jane")
+	userID, err := authenticate(r)
+	assert.Nil(t, err, "no error when the X-HashText-User-ID header is the SHA256 hash for Jane")
+	assert.Equal(t, sha256String("Jane"), userID, "returns the user_id for Jane")
 }
 
 func TestUserHasCredit(t *testing.T) {
 	assert.True(t, userHasCredit(sha256String("Jane")), "Jane has credit")
 	assert.False(t, userHasCredit(sha256String("Petra")), "Petra does not have credit")
+
+	// Credit is a BIGINT, so a balance doesn't wrap around past 32 bits.
+	userID := sha256String("Xiomara")
+	_, err := db.Exec(`UPDATE "user" SET credit = $1 WHERE user_id = $2`, int64(1)<<40, userID)
+	assert.Nil(t, err, "gave Xiomara a lot of credit")
+	defer db.Exec(`UPDATE "user" SET credit = 1000000 WHERE user_id = $1`, userID)
+	assert.True(t, userHasCredit(userID), "Xiomara has credit")
+	u, err := lookupUser(db, userID)
+	assert.Nil(t, err, "no error looking up Xiomara")
+	assert.Equal(t, credit(1)<<40, u.Credit, "got Xiomara's whole balance")
 }
 
 func testUserHandler(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://example.com/user/foo", nil)
-	resp, body := fakeRequest(req, userHandler)
+	resp, body := fakeRequest(req, wrapHandler(userHandler))
 
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for unknown user")
 	assert.Equal(t, []byte{}, body, "no body in response")
 
 	userID := sha256String("Jane")
 	req = httptest.NewRequest("GET", fmt.Sprintf("http://example.com/user/%s", userID), nil)
-	resp, body = fakeRequest(req, userHandler)
+	resp, body = fakeRequest(req, wrapHandler(userHandler))
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for user who exists")
 	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
 
@@ -101,6 +135,35 @@ func testUserHandler(t *testing.T) {
 	assert.Equal(t, userDocument{UserID: userID, Name: "Jane", Credit: 1000000}, "got user data for Jane")
 }
 
+func TestUserHandlerDedupCounts(t *testing.T) {
+	userID := sha256String("Xiomara")
+	getUser := func() userDocument {
+		req := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, body := fakeRequest(req, wrapHandler(userHandler))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for user who exists")
+
+		var u userDocument
+		err := json.Unmarshal(body, &u)
+		assert.Nil(t, err, "no error unmarshalling response body")
+		return u
+	}
+
+	before := getUser()
+	assert.Equal(t, "Xiomara", before.Name, "got user data for Xiomara")
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString(`{"text":"test user handler dedup counts"}`))
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, _ := fakeRequest(req, wrapHandler(textHandler))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 after posting text")
+	}
+
+	after := getUser()
+	assert.Equal(t, before.NovelCount+1, after.NovelCount, "the first submission was novel")
+	assert.Equal(t, before.DuplicateCount+1, after.DuplicateCount, "the second submission was a duplicate")
+}
+
 func TestTextHandler(t *testing.T) {
 	text := "test text handler"
 	j, err := json.Marshal(map[string]string{"text": text})
@@ -109,10 +172,12 @@ func TestTextHandler(t *testing.T) {
 	req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
 	userID := sha256String("Jane")
 	req.Header.Set("X-HashText-User-ID", userID)
-	resp, body := fakeRequest(req, textHandler)
+	resp, body := fakeRequest(req, wrapHandler(textHandler))
 
 	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for user who exists")
 	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+	assert.Equal(t, "1", resp.Header.Get("X-HashText-Credit-Cost"), "got expected credit cost in response")
+	assert.Equal(t, "999999", resp.Header.Get("X-HashText-Credit-Remaining"), "got expected credit remaining in response")
 
 	var hd hashDocument
 	err = json.Unmarshal(body, &hd)
@@ -120,10 +185,10 @@ func TestTextHandler(t *testing.T) {
 	assert.Equal(t, hashDocument{Hash: sha256String(text)}, hd, "got expected reponse after posting text")
 
 	row := db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID)
-	var credit int
+	var credit int64
 	err = row.Scan(&credit)
 	assert.Nil(t, err, "no error looking up credit for Jane")
-	assert.Equal(t, 999999, credit, "credit was debited after inserting text")
+	assert.Equal(t, int64(999999), credit, "credit was debited after inserting text")
 
 	row = db.QueryRow(`SELECT hash, text FROM hash_text WHERE text = $1`, text)
 	var hash string
@@ -136,11 +201,579 @@ func TestTextHandler(t *testing.T) {
 	req = httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
 	userID = sha256String("Petra")
 	req.Header.Set("X-HashText-User-ID", userID)
-	resp, body = fakeRequest(req, textHandler)
+	resp, body = fakeRequest(req, wrapHandler(textHandler))
 
 	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "returned 402 for user without credit")
 	assert.Equal(t, "text/plain; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
 	assert.Equal(t, "You are out of credit. Please pay us more money.", string(body), "got expected error message in body")
+
+	text = "test text handler with a plain text body"
+	req = httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString(text))
+	req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, body = fakeRequest(req, wrapHandler(textHandler))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a plain text body")
+	err = json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String(text)}, hd, "got expected reponse after posting plain text")
+
+	row = db.QueryRow(`SELECT text FROM hash_text WHERE hash = $1`, sha256String(text))
+	err = row.Scan(&dbText)
+	assert.Nil(t, err, "no error looking up hash_text")
+	assert.Equal(t, text, dbText, "stored plain text body as-is in database")
+
+	saved := maxTextBytes
+	maxTextBytes = 32
+	defer func() { maxTextBytes = saved }()
+
+	j, err = json.Marshal(map[string]string{"text": "this text is longer than thirty-two bytes"})
+	assert.Nil(t, err, "no error marshalling textRequest")
+
+	req = httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, _ = fakeRequest(req, wrapHandler(textHandler))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 for a body over the size limit")
+
+	req = httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString("this text is longer than thirty-two bytes"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, _ = fakeRequest(req, wrapHandler(textHandler))
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 for a plain text body over the size limit")
+
+	req = httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString("bad \xff\xfe utf-8"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, body = fakeRequest(req, wrapHandler(textHandler))
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a plain text body that isn't UTF-8")
+	assert.Equal(t, "The text must be valid UTF-8", string(body), "got expected error message in body")
+}
+
+func TestTextHandlerMultipart(t *testing.T) {
+	post := func(parts map[string][]string) (*http.Response, []byte) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for name, values := range parts {
+			for _, v := range values {
+				fw, err := mw.CreateFormFile(name, "text.txt")
+				assert.Nil(t, err, "no error creating a form file")
+				fw.Write([]byte(v))
+			}
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "http://example.com/text", &b)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		return fakeRequest(req, wrapHandler(textHandler))
+	}
+
+	text := "test text handler with a multipart body"
+	resp, body := post(map[string][]string{"text": {text}, "comment": {"ignored"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a multipart body")
+	var hd hashDocument
+	err := json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String(text)}, hd, "got expected reponse after posting a multipart body")
+
+	var dbText string
+	err = db.QueryRow(`SELECT text FROM hash_text WHERE hash = $1`, sha256String(text)).Scan(&dbText)
+	assert.Nil(t, err, "no error looking up hash_text")
+	assert.Equal(t, text, dbText, "stored the text part as-is in database")
+
+	resp, _ = post(map[string][]string{"text": {"one", "two"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for two text parts")
+
+	resp, _ = post(map[string][]string{"comment": {"no text here"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 without a text part")
+
+	resp, _ = post(map[string][]string{"text": {"bad \xc3\x28 utf-8"}})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a text part that isn't UTF-8")
+
+	saved := maxTextBytes
+	maxTextBytes = 32
+	defer func() { maxTextBytes = saved }()
+
+	resp, _ = post(map[string][]string{"text": {"this text is longer than thirty-two bytes"}})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 for a multipart body over the size limit")
+}
+
+func TestTextHandlerMinCredit(t *testing.T) {
+	userID := sha256String("Jane")
+	post := func(text, minCredit string) (*http.Response, []byte) {
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString(text))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-HashText-User-ID", userID)
+		req.Header.Set("X-HashText-Min-Credit", minCredit)
+		return fakeRequest(req, wrapHandler(textHandler))
+	}
+	u, err := lookupUser(db, userID)
+	assert.Nil(t, err, "no error looking up Jane")
+
+	text := "test text handler min credit"
+	resp, body := post(text, strconv.FormatInt(int64(u.Credit)+1, 10))
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "returned 402 when the balance is below the minimum")
+	assert.Contains(t, string(body), "less than the", "said why")
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, sha256String(text)).Scan(&n)
+	assert.Nil(t, err, "no error counting texts")
+	assert.Equal(t, 0, n, "the text wasn't stored")
+
+	resp, _ = post(text, strconv.FormatInt(int64(u.Credit), 10))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when the balance meets the minimum")
+
+	for _, h := range []string{"lots", "-1", "1.5"} {
+		resp, _ = post(text, h)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a minimum of %q", h)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/text/reserve", bytes.NewBufferString(`{"credits":1}`))
+	req.Header.Set("X-HashText-User-ID", userID)
+	req.Header.Set("X-HashText-Min-Credit", "1000000000")
+	resp, _ = fakeRequest(req, wrapHandler(reserveHandler))
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "the minimum applies to reserving credit too")
+}
+
+func TestTextHandlerWithCreditDisabled(t *testing.T) {
+	flags.DisableCredit = true
+	defer func() { flags.DisableCredit = false }()
+
+	assert.True(t, userHasCredit(sha256String("Petra")), "Petra has credit when credit is disabled")
+
+	text := "test text handler with credit disabled"
+	j, err := json.Marshal(map[string]string{"text": text})
+	assert.Nil(t, err, "no error marshalling textRequest")
+
+	req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
+	userID := sha256String("Petra")
+	req.Header.Set("X-HashText-User-ID", userID)
+	resp, body := fakeRequest(req, wrapHandler(textHandler))
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for user without credit")
+	assert.Equal(t, "0", resp.Header.Get("X-HashText-Credit-Cost"), "got expected credit cost in response")
+	assert.Equal(t, "0", resp.Header.Get("X-HashText-Credit-Remaining"), "got expected credit remaining in response")
+
+	var hd hashDocument
+	err = json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String(text)}, hd, "got expected reponse after posting text")
+
+	row := db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID)
+	var credit int64
+	err = row.Scan(&credit)
+	assert.Nil(t, err, "no error looking up credit for Petra")
+	assert.Equal(t, int64(0), credit, "credit was not debited after inserting text")
+}
+
+func TestTextHandlerWithFreeQuota(t *testing.T) {
+	userID := sha256String("Petra")
+	n, err := submissionsToday(userID)
+	assert.Nil(t, err, "no error counting Petra's submissions")
+
+	flags.FreeTextsPerDay = n + 2
+	defer func() { flags.FreeTextsPerDay = 0 }()
+
+	for i := 0; i < 3; i++ {
+		j, err := json.Marshal(map[string]string{"text": fmt.Sprintf("test text handler with free quota %d", i)})
+		assert.Nil(t, err, "no error marshalling textRequest")
+
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, _ := fakeRequest(req, wrapHandler(textHandler))
+
+		if i < 2 {
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for user without credit within the free quota")
+		} else {
+			assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "returned 402 for user without credit after the free quota")
+		}
+	}
+
+	after, err := submissionsToday(userID)
+	assert.Nil(t, err, "no error counting Petra's submissions")
+	assert.Equal(t, n+2, after, "recorded the free submissions")
+}
+
+func TestInsertTextFreeQuotaRace(t *testing.T) {
+	userID := sha256String("Petra")
+	n, err := submissionsToday(userID)
+	assert.Nil(t, err, "no error counting Petra's submissions")
+
+	// Petra has no credit, so she can only store the one text that's free.
+	flags.FreeTextsPerDay = n + 1
+	defer func() { flags.FreeTextsPerDay = 0 }()
+
+	var g errgroup.Group
+	errs := make([]error, 10)
+	for i := range errs {
+		i := i
+		g.Go(func() error {
+			text := fmt.Sprintf("test insert text free quota race %d", i)
+			_, errs[i] = insertText(context.Background(), text, sha256String(text), userID, 0)
+			return nil
+		})
+	}
+	g.Wait()
+
+	var ok, outOfCredit int
+	for _, err := range errs {
+		switch err {
+		case nil:
+			ok++
+		case errOutOfCredit:
+			outOfCredit++
+		}
+	}
+	assert.Equal(t, 1, ok, "only one submission was free")
+	assert.Equal(t, len(errs)-1, outOfCredit, "the rest couldn't be paid for")
+
+	after, err := submissionsToday(userID)
+	assert.Nil(t, err, "no error counting Petra's submissions")
+	assert.Equal(t, n+1, after, "only the free submission was recorded")
+}
+
+func TestInsertTextWaitsForUserLock(t *testing.T) {
+	debitLocks = newUserLocks()
+	defer func() { debitLocks = nil }()
+	userID := sha256String("Xiomara")
+	text := "test insert text waits for user lock"
+
+	// Holding the user's lock keeps insertText from even beginning its
+	// transaction, so it can't be queued on the user's row in Postgres.
+	debitLocks.lock(userID)
+	done := make(chan error)
+	go func() {
+		_, err := insertText(context.Background(), text, sha256String(text), userID, 0)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("insertText didn't wait for the user's lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	debitLocks.unlock(userID)
+	assert.Nil(t, <-done, "stored the text once the lock was free")
+	assert.Equal(t, 0, debitLocks.size(), "released the user's lock")
+}
+
+func TestTextHandlerWithByteQuota(t *testing.T) {
+	userID := sha256String("Jane")
+	var stored int64
+	err := db.QueryRow(`SELECT stored_bytes FROM "user" WHERE user_id = $1`, userID).Scan(&stored)
+	assert.Nil(t, err, "no error looking up Jane's stored bytes")
+
+	text := "test text handler with byte quota"
+	userByteQuota = stored + int64(len(text))
+	defer func() { userByteQuota = 0 }()
+
+	post := func(text string) (*http.Response, []byte) {
+		j, err := json.Marshal(map[string]string{"text": text})
+		assert.Nil(t, err, "no error marshalling textRequest")
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(j))
+		req.Header.Set("X-HashText-User-ID", userID)
+		return fakeRequest(req, wrapHandler(textHandler))
+	}
+
+	resp, _ := post(text)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a text that fits in the quota")
+
+	err = db.QueryRow(`SELECT stored_bytes FROM "user" WHERE user_id = $1`, userID).Scan(&stored)
+	assert.Nil(t, err, "no error looking up Jane's stored bytes")
+	assert.Equal(t, userByteQuota, stored, "stored bytes include the new text")
+
+	resp, _ = post(text)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a text that's already stored")
+
+	resp, body := post("one more text")
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode, "returned 507 for a text over the quota")
+	assert.Contains(t, string(body), fmt.Sprintf("You are using %d of %d bytes", stored, userByteQuota), "error includes usage and limit")
+}
+
+func TestInsertTextCollision(t *testing.T) {
+	// We can't find a real SHA256 collision, so we store a text under a hash
+	// that belongs to some other text.
+	hash := sha256String("test insert text collision")
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2)", hash, "some other text")
+	assert.Nil(t, err, "inserted text and hash")
+
+	_, err = insertText(context.Background(), "test insert text collision", hash, sha256String("Xiomara"), 0)
+	assert.Equal(t, hashstore.ErrHashCollision, err, "got a collision error for a different text with the same hash")
+
+	_, err = insertText(context.Background(), "some other text", hash, sha256String("Xiomara"), 0)
+	assert.Nil(t, err, "no error inserting the same text again")
+}
+
+func TestInsertTextRace(t *testing.T) {
+	text := "test insert text race"
+	hash := sha256String(text)
+	userID := sha256String("Jane")
+
+	var g errgroup.Group
+	costs := make([]credit, 10)
+	for i := range costs {
+		i := i
+		g.Go(func() error {
+			d, err := insertText(context.Background(), text, hash, userID, 0)
+			costs[i] = d.cost
+			return err
+		})
+	}
+	assert.Nil(t, g.Wait(), "no error from concurrent inserts")
+
+	var charged credit
+	for _, c := range costs {
+		charged += c
+	}
+	assert.Equal(t, credit(1), charged, "only the insert that stored the text was charged")
+
+	var novel, duplicate int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FILTER (WHERE NOT duplicate), COUNT(*) FILTER (WHERE duplicate) FROM submission WHERE hash = $1`,
+		hash,
+	).Scan(&novel, &duplicate)
+	assert.Nil(t, err, "no error counting submissions")
+	assert.Equal(t, 1, novel, "one submission stored the text")
+	assert.Equal(t, 9, duplicate, "the rest were duplicates")
+}
+
+func TestInsertTextQuotaRace(t *testing.T) {
+	userID := sha256String("Xiomara")
+	var stored int64
+	err := db.QueryRow(`SELECT stored_bytes FROM "user" WHERE user_id = $1`, userID).Scan(&stored)
+	assert.Nil(t, err, "no error looking up Xiomara's stored bytes")
+
+	// There's room for exactly one of the texts.
+	texts := make([]string, 10)
+	for i := range texts {
+		texts[i] = fmt.Sprintf("test insert text quota race %d", i)
+	}
+	quota := stored + int64(len(texts[0]))
+
+	var g errgroup.Group
+	errs := make([]error, len(texts))
+	for i, text := range texts {
+		i, text := i, text
+		g.Go(func() error {
+			_, errs[i] = insertText(context.Background(), text, sha256String(text), userID, quota)
+			return nil
+		})
+	}
+	g.Wait()
+
+	var ok, overQuota int
+	for _, err := range errs {
+		var qe *hashstore.QuotaError
+		switch {
+		case err == nil:
+			ok++
+		case errors.As(err, &qe):
+			overQuota++
+		}
+	}
+	assert.Equal(t, 1, ok, "only one text fit in the quota")
+	assert.Equal(t, len(texts)-1, overQuota, "the rest were over the quota")
+
+	err = db.QueryRow(`SELECT stored_bytes FROM "user" WHERE user_id = $1`, userID).Scan(&stored)
+	assert.Nil(t, err, "no error looking up Xiomara's stored bytes")
+	assert.Equal(t, quota, stored, "stored bytes reached the quota without going over")
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE text LIKE 'test insert text quota race %'`).Scan(&count)
+	assert.Nil(t, err, "no error counting texts")
+	assert.Equal(t, 1, count, "the texts over the quota weren't stored")
+}
+
+func TestInsertTextCancelled(t *testing.T) {
+	text := "test insert text cancelled"
+	hash := sha256String(text)
+	userID := sha256String("Jane")
+
+	// Locking Jane's row makes insertText wait part way through its
+	// transaction, after it has inserted the text.
+	blocker, err := db.Begin()
+	assert.Nil(t, err, "no error beginning a transaction")
+	defer blocker.Rollback()
+	_, err = blocker.Exec(`SELECT 1 FROM "user" WHERE user_id = $1 FOR UPDATE`, userID)
+	assert.Nil(t, err, "locked Jane's row")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := insertText(ctx, text, hash, userID, 0)
+		done <- err
+	}()
+
+	waiting := false
+	for deadline := time.Now().Add(5 * time.Second); !waiting && time.Now().Before(deadline); {
+		err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pg_locks WHERE NOT granted`).Scan(&waiting)
+		assert.Nil(t, err, "no error looking for waiting locks")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, waiting, "insertText is waiting for Jane's row")
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err, "insertText failed when its context was cancelled")
+	case <-time.After(5 * time.Second):
+		t.Fatal("insertText didn't give up when its context was cancelled")
+	}
+	assert.Nil(t, blocker.Rollback(), "released Jane's row")
+
+	var texts, submissions int
+	err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, hash).Scan(&texts)
+	assert.Nil(t, err, "no error counting texts")
+	assert.Equal(t, 0, texts, "the text wasn't stored")
+	err = db.QueryRow(`SELECT COUNT(*) FROM submission WHERE hash = $1`, hash).Scan(&submissions)
+	assert.Nil(t, err, "no error counting submissions")
+	assert.Equal(t, 0, submissions, "the submission wasn't recorded")
+
+	// If the cancelled transaction had kept its lock on the hash, storing the
+	// same text again would wait for it until the timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d, err := insertText(ctx, text, hash, userID, 0)
+	assert.Nil(t, err, "no error storing the text after the cancelled attempt")
+	assert.Equal(t, credit(1), d.cost, "charged for the text, which is new")
+}
+
+func TestHashHandler(t *testing.T) {
+	text := "test hash handler"
+	j, err := json.Marshal(map[string]string{"text": text})
+	assert.Nil(t, err, "no error marshalling textRequest")
+
+	req := httptest.NewRequest("POST", "http://example.com/hash", bytes.NewBuffer(j))
+	resp, body := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without a user ID")
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+
+	var hd hashDocument
+	err = json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String(text), Algorithm: "sha256"}, hd, "got expected reponse after posting text")
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, hd.Hash).Scan(&count)
+	assert.Nil(t, err, "no error looking up hash_text")
+	assert.Equal(t, 0, count, "text was not stored")
+
+	req = httptest.NewRequest("POST", "http://example.com/hash", bytes.NewBufferString(`{"foo":"bar"}`))
+	resp, _ = fakeRequest(req, hashHandler)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 when there is no text key")
+
+	req = httptest.NewRequest("POST", "http://example.com/hash", bytes.NewBufferString(`not json`))
+	resp, _ = fakeRequest(req, hashHandler)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 when the body is not JSON")
+}
+
+func TestHashHandlerAlgorithm(t *testing.T) {
+	hash := func(query string) (*http.Response, hashDocument) {
+		req := httptest.NewRequest("POST", "http://example.com/hash"+query, strings.NewReader(`{"text":"hello"}`))
+		resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+		var hd hashDocument
+		json.Unmarshal(body, &hd)
+		return resp, hd
+	}
+
+	for algo, want := range map[string]string{
+		"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"sha384": "59e1748777448c69de6b800d7a33bbfb9ff1b463e44354c3553bcdb9c666fa90125a3c79f90397bdf5f6a13de828684f",
+		"sha512": "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+	} {
+		resp, hd := hash("?algo=" + algo)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for %s", algo)
+		assert.Equal(t, hashDocument{Hash: want, Algorithm: algo}, hd, "hashed the text with %s", algo)
+	}
+
+	resp, _ := hash("?algo=md5")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for an algorithm that isn't allowed")
+
+	req := httptest.NewRequest("POST", "http://example.com/hash/stream?algo=sha512", strings.NewReader("hello"))
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a stream")
+	var hd hashDocument
+	assert.Nil(t, json.Unmarshal(body, &hd), "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{
+		Hash:      "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+		Algorithm: "sha512",
+	}, hd, "hashed the stream with sha512")
+
+	req = httptest.NewRequest("POST", "http://example.com/hash/stream?algo=sha3", strings.NewReader("hello"))
+	resp, _ = fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a stream with an algorithm that isn't allowed")
+}
+
+func TestHashStreamHandler(t *testing.T) {
+	text := strings.Repeat("test hash stream handler\n", 100000)
+	req := httptest.NewRequest("POST", "http://example.com/hash/stream", strings.NewReader(text))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a body larger than maxTextBytes")
+
+	var hd hashDocument
+	err := json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: hashText(text), Algorithm: "sha256"}, hd, "got the same hash as hashing the text")
+
+	saved := maxStreamBytes
+	maxStreamBytes = 10
+	defer func() { maxStreamBytes = saved }()
+
+	req = httptest.NewRequest("POST", "http://example.com/hash/stream", strings.NewReader(text))
+	resp, _ = fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 when Content-Length is over maxStreamBytes")
+
+	req = httptest.NewRequest("POST", "http://example.com/hash/stream", ioutil.NopCloser(strings.NewReader(text)))
+	req.ContentLength = -1
+	resp, _ = fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 when a body of unknown length goes over maxStreamBytes")
+}
+
+func TestTextVerifyHandler(t *testing.T) {
+	text := "test text verify handler"
+	hash := sha256String(text)
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2)", hash, text)
+	assert.Nil(t, err, "inserted text and hash")
+
+	verify := func(path, body string) (*http.Response, verifyDocument) {
+		req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", sha256String("Petra"))
+		resp, respBody := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+		var vd verifyDocument
+		if resp.StatusCode == http.StatusOK {
+			err := json.Unmarshal(respBody, &vd)
+			assert.Nil(t, err, "no error unmarshalling response body")
+		}
+		return resp, vd
+	}
+
+	resp, vd := verify("/text/"+hash+"/verify", `{"text":"test text verify handler"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a user without credit")
+	assert.Equal(t, verifyDocument{Matches: true, Stored: true}, vd, "the stored text matches its hash")
+
+	_, vd = verify("/text/"+hash+"/verify", `{"text":"something else"}`)
+	assert.Equal(t, verifyDocument{Matches: false, Stored: true}, vd, "a different text doesn't match")
+
+	other := sha256String("test text verify handler, not stored")
+	_, vd = verify("/text/"+other+"/verify", `{"text":"test text verify handler, not stored"}`)
+	assert.Equal(t, verifyDocument{Matches: true, Stored: false}, vd, "a text can match a hash that isn't stored")
+
+	resp, _ = verify("/text/"+hash+"/verify", `{"foo":"bar"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 when there is no text key")
+
+	resp, _ = verify("/text/not-a-hash/verify", `{"text":"x"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for a malformed hash")
+}
+
+func TestNewTextDocument(t *testing.T) {
+	assert.Equal(t, textDocument{Text: "héllo", Length: 6, RuneCount: 5}, newTextDocument("héllo"), "counts bytes and runes separately")
+
+	b, err := json.Marshal(newTextDocument(""))
+	assert.Nil(t, err, "no error marshalling an empty text")
+	assert.JSONEq(t, `{"text":"","length":0,"rune_count":0}`, string(b), "sent the sizes of an empty text")
 }
 
 func TestTextHashHandler(t *testing.T) {
@@ -163,7 +796,22 @@ func TestTextHashHandler(t *testing.T) {
 
 	var td textDocument
 	err = json.Unmarshal(body, &td)
-	assert.Equal(t, textDocument{Text: text}, td, "got text for hash")
+	assert.Equal(t, textDocument{Text: text, Length: len(text), RuneCount: len(text)}, td, "got text and its size for hash")
+
+	accessUpdates.Wait()
+	var lastAccessed sql.NullTime
+	err = db.QueryRow(`SELECT last_accessed_at FROM hash_text WHERE hash = $1`, hash).Scan(&lastAccessed)
+	assert.Nil(t, err, "no error looking up last_accessed_at")
+	assert.True(t, lastAccessed.Valid, "last_accessed_at was set by reading the text")
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("http://example.com/text/%s", hash), nil)
+	req.Header.Set("X-HashText-User-ID", userID)
+	req.Header.Set("Accept", "text/plain")
+	resp, body = fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for hash which exists with Accept: text/plain")
+	assert.Equal(t, "text/plain; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+	assert.Equal(t, text, string(body), "got raw text for hash")
 
 	req = httptest.NewRequest("GET", "http://example.com/text/does-not-exist", nil)
 	req.Header.Set("X-HashText-User-ID", userID)
@@ -172,6 +820,171 @@ func TestTextHashHandler(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for hash which does not exist")
 }
 
+func TestAcceptsPlainText(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                   false,
+		"text/plain":                         true,
+		"application/json":                   false,
+		"*/*":                                false,
+		"text/plain, application/json":       true,
+		"application/json, text/plain":       false,
+		"application/*, text/plain":          false,
+		"text/plain;q=0, application/json":   false,
+		"text/plain;q=0":                     false,
+		"application/json;q=0.5, text/plain": true,
+		"text/plain;q=0.5, application/json": false,
+		"text/*, application/json;q=0.9":     true,
+		"text/*;q=0.1, text/plain":           true,
+		"text/plain;q=nonsense, */*":         false,
+	} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept", accept)
+		assert.Equal(t, want, acceptsPlainText(req), "Accept: %s", accept)
+	}
+}
+
+func TestTextHashHandlerWithHash(t *testing.T) {
+	text := "test text hash handler with hash"
+	hash := hashText(text)
+	corruptHash := hashText("test text hash handler with hash before corruption")
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2), ($3, $2)", hash, text, corruptHash)
+	assert.Nil(t, err, "inserted text under its own hash and another one")
+
+	get := func(hash, query, accept string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com/text/"+hash+query, nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return fakeRequest(req, makeRouter().ServeHTTP)
+	}
+
+	matches, mismatches := true, false
+	for _, c := range []struct {
+		hash, query string
+		want        textDocument
+	}{
+		{hash, "", newTextDocument(text)},
+		{hash, "?with_hash=0", newTextDocument(text)},
+		{hash, "?with_hash=1", textDocument{Text: text, Length: len(text), RuneCount: len(text), Hash: hash, HashMatches: &matches}},
+		{corruptHash, "?with_hash=1", textDocument{Text: text, Length: len(text), RuneCount: len(text), Hash: hash, HashMatches: &mismatches}},
+	} {
+		resp, body := get(c.hash, c.query, "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for %s", c.query)
+		var td textDocument
+		assert.Nil(t, json.Unmarshal(body, &td), "no error unmarshalling response body")
+		assert.Equal(t, c.want, td, "got expected document for %s%s", c.hash, c.query)
+	}
+
+	resp, _ := get(corruptHash, "?with_hash=1", "text/plain")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with Accept: text/plain")
+	assert.Equal(t, hash, resp.Header.Get("X-HashText-Hash"), "sent the recomputed hash in a header")
+	assert.Equal(t, "false", resp.Header.Get("X-HashText-Hash-Matches"), "sent the mismatch in a header")
+
+	resp, _ = get(hash, "?with_hash=yes", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a with_hash that isn't 0 or 1")
+}
+
+func TestTextHashHandlerRange(t *testing.T) {
+	text := "test text hash handler range"
+	hash := hashText(text)
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2)", hash, text)
+	assert.Nil(t, err, "inserted text")
+
+	get := func(accept, rangeHeader string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com/text/"+hash, nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		req.Header.Set("Accept", accept)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		return fakeRequest(req, makeRouter().ServeHTTP)
+	}
+
+	resp, body := get("text/plain", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without a Range header")
+	assert.Equal(t, text, string(body), "got the whole text")
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"), "said that ranges are accepted")
+
+	resp, body = get("text/plain", "bytes=5-8")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode, "returned 206 for a range")
+	assert.Equal(t, "text", string(body), "got the bytes in the range")
+	assert.Equal(t, fmt.Sprintf("bytes 5-8/%d", len(text)), resp.Header.Get("Content-Range"), "got the Content-Range header")
+	assert.Equal(t, "text/plain; charset=UTF-8", resp.Header.Get("Content-Type"), "kept the text Content-Type")
+
+	resp, body = get("text/plain", "bytes=-5")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode, "returned 206 for a suffix range")
+	assert.Equal(t, "range", string(body), "got the last bytes")
+
+	resp, _ = get("text/plain", fmt.Sprintf("bytes=%d-", len(text)))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode, "returned 416 for a range past the end")
+	assert.Equal(t, fmt.Sprintf("bytes */%d", len(text)), resp.Header.Get("Content-Range"), "said how long the text is")
+
+	resp, body = get("application/json", "bytes=5-8")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "JSON ignores the Range header")
+	var td textDocument
+	assert.Nil(t, json.Unmarshal(body, &td), "no error unmarshalling response body")
+	assert.Equal(t, text, td.Text, "got the whole text as JSON")
+}
+
+func TestReadTextCoalesces(t *testing.T) {
+	text := "test read text coalesces"
+	hash := hashText(text)
+	var queries int32
+	saved := lookupText
+	lookupText = func(string) (string, sql.NullTime, error) {
+		atomic.AddInt32(&queries, 1)
+		// Hold the query open long enough for every reader to join it.
+		time.Sleep(100 * time.Millisecond)
+		return text, sql.NullTime{Time: time.Now(), Valid: true}, nil
+	}
+	defer func() { lookupText = saved }()
+
+	var g errgroup.Group
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			got, ok := readText(httptest.NewRecorder(), hash)
+			assert.True(t, ok, "read the text")
+			assert.Equal(t, text, got, "got the text")
+			return nil
+		})
+	}
+	g.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries), "concurrent reads of one hash shared one query")
+
+	readText(httptest.NewRecorder(), hash)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries), "a later read makes its own query")
+}
+
+func TestTextHashHandlerNotFound(t *testing.T) {
+	defer func() { flags.TextNotFound = textNotFoundJSON }()
+	hash := hashText("test text hash handler not found")
+	get := func() (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com/text/"+hash, nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		return fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+	}
+
+	flags.TextNotFound = textNotFoundJSON
+	resp, body := get()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 with 404-json")
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "sent JSON with 404-json")
+	var nd textNotFoundDocument
+	assert.Nil(t, json.Unmarshal(body, &nd), "no error unmarshalling response body")
+	assert.Equal(t, textNotFoundDocument{Error: "No text is stored with this hash", Hash: hash}, nd, "body says which hash is missing")
+
+	flags.TextNotFound = textNotFoundEmpty
+	resp, body = get()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 with 404-empty")
+	assert.Empty(t, body, "sent no body with 404-empty")
+
+	flags.TextNotFound = textNotFoundNull
+	resp, body = get()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with 200-null")
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "sent JSON with 200-null")
+	assert.Equal(t, "null", string(body), "sent a null body with 200-null")
+}
+
 func fakeRequest(
 	req *http.Request,
 	handler func(w http.ResponseWriter, r *http.Request),
@@ -185,3 +998,335 @@ func fakeRequest(
 
 	return resp, respBody
 }
+
+func TestCanonicalJSON(t *testing.T) {
+	body, err := canonicalJSON([]byte(`{"zebra":"\u003cb\u003e\u0026\u003c/b\u003e","apple":{"b":2,"a":9007199254740993}}`))
+	assert.Nil(t, err, "no error encoding canonical JSON")
+	assert.Equal(t, `{"apple":{"a":9007199254740993,"b":2},"zebra":"<b>&</b>"}`+"\n", string(body), "keys are sorted and HTML isn't escaped")
+
+	flags.CanonicalJSON = true
+	defer func() { flags.CanonicalJSON = false }()
+	w := httptest.NewRecorder()
+	sendJSONResponse(w, hashDocument{Hash: "<>"})
+	assert.Equal(t, `{"hash":"<>"}`+"\n", w.Body.String(), "sendJSONResponse uses canonical JSON when the flag is set")
+}
+
+func TestServiceNotice(t *testing.T) {
+	serviceNotice = "Maintenance at 2am"
+	defer func() { serviceNotice = "" }()
+
+	w := httptest.NewRecorder()
+	sendJSONResponse(w, hashDocument{Hash: "abc"})
+	assert.Equal(t, `{"notice":"Maintenance at 2am","hash":"abc"}`, w.Body.String(), "notice was added to the JSON object")
+
+	w = httptest.NewRecorder()
+	sendJSONResponse(w, struct{}{})
+	assert.Equal(t, `{"notice":"Maintenance at 2am"}`, w.Body.String(), "notice was added to an empty object")
+
+	w = httptest.NewRecorder()
+	sendJSONResponse(w, []string{"a"})
+	assert.Equal(t, `["a"]`, w.Body.String(), "arrays are left alone")
+
+	req := httptest.NewRequest("GET", "http://example.com/livez", nil)
+	resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, "Maintenance at 2am", resp.Header.Get("X-HashText-Notice"), "got the notice header")
+}
+
+func TestWriteNDJSONLine(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, writeNDJSONLine(&b, hashDocument{Hash: "<>"}), "no error writing a line")
+	assert.Nil(t, writeNDJSONLine(&b, hashDocument{Hash: "abc"}), "no error writing another line")
+	assert.Equal(t, `{"hash":"\u003c\u003e"}`+"\n"+`{"hash":"abc"}`+"\n", b.String(), "wrote one object per line")
+
+	serviceNotice = "Maintenance at 2am"
+	defer func() { serviceNotice = "" }()
+	flags.CanonicalJSON = true
+	defer func() { flags.CanonicalJSON = false }()
+	b.Reset()
+	assert.Nil(t, writeNDJSONLine(&b, hashDocument{Hash: "<>"}), "no error writing a canonical line")
+	assert.Equal(t, `{"hash":"<>","notice":"Maintenance at 2am"}`+"\n", b.String(), "the line is canonical and has the notice")
+}
+
+func TestSendJSONResponseEncodeError(t *testing.T) {
+	unencodable := map[string]interface{}{"hash": "abc", "callback": func() {}}
+
+	w := httptest.NewRecorder()
+	sendJSONResponse(w, unencodable)
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "returned 500 when the response can't be encoded")
+	assert.Equal(t, "application/json; charset=UTF-8", w.Header().Get("Content-Type"), "got a JSON Content-Type")
+	assert.JSONEq(t, `{"error":"Internal server error"}`, w.Body.String(), "got the static error body")
+
+	w = httptest.NewRecorder()
+	sendJSONResponseWithStatus(w, http.StatusCreated, unencodable)
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "returned 500 rather than the status asked for")
+
+	flags.ErrorFormat = errorFormatProblem
+	defer func() { flags.ErrorFormat = errorFormatText }()
+	w = httptest.NewRecorder()
+	sendJSONResponse(w, unencodable)
+	assert.Equal(t, http.StatusInternalServerError, w.Code, "returned 500 with problem details")
+	assert.Equal(t, "application/problem+json; charset=UTF-8", w.Header().Get("Content-Type"), "got the problem Content-Type")
+	var pd problemDocument
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &pd), "no error unmarshalling the problem")
+	assert.Equal(t, problemDocument{Type: "about:blank", Title: "Internal Server Error", Status: 500}, pd, "got the static problem body")
+}
+
+func TestUserPatchHandler(t *testing.T) {
+	userID := sha256String("Petra")
+	router := makeRouter()
+
+	req := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+	req.Header.Set("X-HashText-User-ID", userID)
+	resp, body := fakeRequest(req, router.ServeHTTP)
+
+	var u userDocument
+	err := json.Unmarshal(body, &u)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, fmt.Sprintf(`"%d-%d-%d"`, u.Version, u.NovelCount, u.DuplicateCount), etag, "ETag is the user's version and counts")
+
+	patch := func(ifMatch, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest("PATCH", "http://example.com/user/me", bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", userID)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return fakeRequest(req, router.ServeHTTP)
+	}
+
+	resp, _ = patch("", `{"name":"Petra P."}`)
+	assert.Equal(t, http.StatusPreconditionRequired, resp.StatusCode, "returned 428 without If-Match")
+
+	resp, body = patch(etag, `{"name":"Petra P."}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with the current ETag")
+
+	var patched userDocument
+	err = json.Unmarshal(body, &patched)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, "Petra P.", patched.Name, "name was updated")
+	assert.Equal(t, u.Version+1, patched.Version, "version was bumped")
+	assert.Equal(t, patched.etag(), resp.Header.Get("ETag"), "got the new ETag")
+
+	resp, _ = patch(etag, `{"name":"Someone Else"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode, "returned 412 with a stale ETag")
+
+	resp, body = patch("*", `{"name":"Petra Star"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with If-Match: *")
+	err = json.Unmarshal(body, &patched)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, "Petra Star", patched.Name, "name was updated without a version")
+
+	resp, _ = patch(fmt.Sprintf(`"%d"`, patched.Version), `{"name":"Petra"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "put Petra's name back with a bare version")
+}
+
+func TestUserPatchHandlerMergePatch(t *testing.T) {
+	userID := sha256String("Petra")
+	router := makeRouter()
+	patch := func(body string) (*http.Response, userDocument) {
+		u, err := lookupUser(db, userID)
+		assert.Nil(t, err, "no error looking up Petra")
+		req := httptest.NewRequest("PATCH", "http://example.com/user/me", bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", userID)
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.Header.Set("If-Match", u.etag())
+		resp, respBody := fakeRequest(req, router.ServeHTTP)
+		var patched userDocument
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(respBody, &patched), "no error unmarshalling response body")
+		}
+		return resp, patched
+	}
+
+	before, err := lookupUser(db, userID)
+	assert.Nil(t, err, "no error looking up Petra")
+
+	resp, patched := patch(`{}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for an empty patch")
+	assert.Equal(t, before, patched, "an empty patch changed nothing")
+
+	resp, patched = patch(`{"name":"Petra Q."}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a partial patch")
+	assert.Equal(t, "Petra Q.", patched.Name, "the patched field was changed")
+	assert.Equal(t, before.Credit, patched.Credit, "fields left out of the patch were left alone")
+	assert.Equal(t, before.Version+1, patched.Version, "version was bumped")
+	defer db.Exec(`UPDATE "user" SET name = 'Petra' WHERE user_id = $1`, userID)
+
+	for body, status := range map[string]int{
+		`{"credit":1000}`:                     http.StatusBadRequest,
+		`{"name":"Rich Petra","credit":1000}`: http.StatusBadRequest,
+		`{"user_id":"someone"}`:               http.StatusBadRequest,
+		`{"name":null}`:                       http.StatusBadRequest,
+		`{"name":""}`:                         http.StatusBadRequest,
+		`{"nickname":"P"}`:                    http.StatusBadRequest,
+		`null`:                                http.StatusBadRequest,
+		`["name"]`:                            http.StatusBadRequest,
+	} {
+		resp, _ := patch(body)
+		assert.Equal(t, status, resp.StatusCode, "returned %d for %s", status, body)
+	}
+
+	after, err := lookupUser(db, userID)
+	assert.Nil(t, err, "no error looking up Petra")
+	assert.Equal(t, patched, after, "the rejected patches changed nothing")
+}
+
+func TestUserHandlerIfNoneMatch(t *testing.T) {
+	userID := sha256String("Petra")
+	router := makeRouter()
+	get := func(ifNoneMatch string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return fakeRequest(req, router.ServeHTTP)
+	}
+
+	resp, _ := get("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without If-None-Match")
+	etag := resp.Header.Get("ETag")
+
+	resp, body := get(etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, "returned 304 with the current ETag")
+	assert.Equal(t, etag, resp.Header.Get("ETag"), "sent the ETag with the 304")
+	assert.Empty(t, body, "sent no body with the 304")
+
+	resp, _ = get(`"0-0-0", W/` + etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode, "returned 304 when any listed ETag matches")
+
+	resp, _ = get(`"0-0-0"`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 with a stale ETag")
+}
+
+func TestNonHexHashesAreNotPadded(t *testing.T) {
+	saved := textDigest
+	defer func() { textDigest = saved }()
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	for _, encoding := range []string{"base64url", "base32"} {
+		de, err := hashstore.ParseDigestEncoding(encoding)
+		assert.Nil(t, err, "no error parsing %s", encoding)
+		textDigest = de
+
+		name := "Ursula " + encoding
+		userID := sha256String(name)
+		execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, $2, 0)`, userID, name)
+		text := "test unpadded hash " + encoding
+		hash := hashText(text)
+		_, err = storeText(context.Background(), db, text, hash, userID, 0)
+		assert.Nil(t, err, "no error storing text with %s", encoding)
+
+		router := makeRouter()
+		get := func(path, user string) []byte {
+			req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+			req.Header.Set("X-HashText-User-ID", user)
+			resp, body := fakeRequest(req, router.ServeHTTP)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for %s", path)
+			return body
+		}
+
+		var ld userHashListDocument
+		assert.Nil(t, json.Unmarshal(get("/user/me/hashes", userID), &ld), "no error unmarshalling hashes")
+		if assert.Len(t, ld.Hashes, 1, "listed the %s text", encoding) {
+			assert.Equal(t, hash, ld.Hashes[0].Hash, "listed the %s hash without padding", encoding)
+		}
+
+		var md textMetaDocument
+		assert.Nil(t, json.Unmarshal(get("/admin/text/"+hash+"/meta", adminID), &md), "no error unmarshalling meta")
+		assert.Equal(t, hash, md.Hash, "got the %s hash in the meta without padding", encoding)
+
+		var stored string
+		err = db.QueryRow(`SELECT hash FROM submission WHERE user_id = $1`, userID).Scan(&stored)
+		assert.Nil(t, err, "no error looking up the submission")
+		assert.Equal(t, hash, stored, "the submission has the %s hash without padding", encoding)
+	}
+}
+
+func TestUserHashesHandler(t *testing.T) {
+	userID := sha256String("Zelda")
+	execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, 'Zelda', 0)`, userID)
+
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		text := fmt.Sprintf("test user hashes handler %d", i)
+		_, err := storeText(context.Background(), db, text, hashText(text), userID, 0)
+		assert.Nil(t, err, "no error storing text")
+		hashes = append(hashes, hashText(text))
+	}
+	// Zelda submitting a text someone else stored doesn't make it hers.
+	_, err := storeText(context.Background(), db, "test user hashes handler", hashText("test user hashes handler"), sha256String("Jane"), 0)
+	assert.Nil(t, err, "no error storing text")
+	_, err = storeText(context.Background(), db, "test user hashes handler", hashText("test user hashes handler"), userID, 0)
+	assert.Nil(t, err, "no error storing text")
+
+	router := makeRouter()
+	list := func(query string) (*http.Response, userHashListDocument) {
+		req := httptest.NewRequest("GET", "http://example.com/user/me/hashes"+query, nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, body := fakeRequest(req, router.ServeHTTP)
+		var ld userHashListDocument
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(body, &ld), "no error unmarshalling response body")
+		}
+		return resp, ld
+	}
+	got := func(ld userHashListDocument) []string {
+		var hs []string
+		for _, h := range ld.Hashes {
+			hs = append(hs, h.Hash)
+		}
+		return hs
+	}
+
+	resp, ld := list("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 listing hashes")
+	assert.ElementsMatch(t, hashes, got(ld), "listed the hashes of the texts Zelda stored")
+	assert.Nil(t, ld.NextOffset, "no next page")
+
+	resp, ld = list("?limit=2")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the first page")
+	assert.Len(t, ld.Hashes, 2, "got a page of two hashes")
+	if assert.NotNil(t, ld.NextOffset, "got a next page") {
+		assert.Equal(t, 2, *ld.NextOffset, "next page starts after this one")
+	}
+	first := got(ld)
+
+	resp, ld = list("?limit=2&offset=2")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the second page")
+	assert.Len(t, ld.Hashes, 1, "got the last hash")
+	assert.Nil(t, ld.NextOffset, "no page after the last one")
+	assert.ElementsMatch(t, hashes, append(first, got(ld)...), "the pages together list every hash")
+	assert.False(t, ld.Truncated, "pages weren't truncated")
+
+	// A hash with its created_at is over 100 bytes of JSON, so only one fits.
+	saved := maxPageBytes
+	maxPageBytes = 150
+	defer func() { maxPageBytes = saved }()
+	resp, ld = list("?limit=2")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a page over the byte cap")
+	assert.Len(t, ld.Hashes, 1, "got as many hashes as fit in the byte cap")
+	assert.True(t, ld.Truncated, "page was truncated")
+	if assert.NotNil(t, ld.NextOffset, "got a next page") {
+		assert.Equal(t, 1, *ld.NextOffset, "next page starts after the truncated one")
+	}
+
+	resp, _ = list("?limit=0")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a bad limit")
+}
+
+func TestEtagVersion(t *testing.T) {
+	for etag, want := range map[string]int64{
+		`"7-3-1"`:   7,
+		`W/"7-3-1"`: 7,
+		`"7"`:       7,
+	} {
+		v, err := etagVersion(etag)
+		assert.Nil(t, err, "no error parsing %s", etag)
+		assert.Equal(t, want, v, "got the version from %s", etag)
+	}
+	_, err := etagVersion(`"nope"`)
+	assert.NotNil(t, err, "error parsing an ETag we didn't make")
+}
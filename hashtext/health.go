@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once we've been asked to shut down, so that /readyz tells
+// the load balancer to stop sending us requests while we finish the ones we
+// have.
+var draining atomic.Bool
+
+// livezHandler only says that the process is up and serving HTTP. It never
+// checks the database, so a database outage doesn't get the process killed
+// and restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	sendTextResponse(w, "ok")
+}
+
+// readyzHandler says whether we can usefully serve requests right now, which
+// means we aren't shutting down and we can reach the database.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		sendErrorMessage(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	// With the replica fallback on, we can serve reads without the replica,
+	// so only the primary has to be reachable.
+	pools := []*sql.DB{db}
+	if readDB != db && !flags.ReplicaFallback {
+		pools = append(pools, readDB)
+	}
+	for _, pool := range pools {
+		if err := pool.PingContext(ctx); err != nil {
+			log.Printf("Readiness check could not reach the database: %v", err)
+			sendErrorMessage(w, "The database is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	sendTextResponse(w, "ok")
+}
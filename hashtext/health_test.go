@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivezHandler(t *testing.T) {
+	// Liveness must not depend on the database.
+	saved := db
+	db = nil
+	defer func() { db = saved }()
+
+	req := httptest.NewRequest("GET", "http://example.com/livez", nil)
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200")
+	assert.Equal(t, "ok", string(body), "got expected body")
+}
+
+func TestReadyzHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/readyz", nil)
+	resp, _ := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when the database is reachable")
+
+	draining.Store(true)
+	defer draining.Store(false)
+	resp, _ = fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 while shutting down")
+}
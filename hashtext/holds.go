@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+)
+
+// Credit holds let a client set credit aside before doing some work, and then
+// either spend it on a text or give it back. Reserving moves the credit out of
+// the user's balance and into a credit_hold row, so the balance is always what
+// the user has available to spend.
+
+// holdTTL is how long a hold lasts before the pruner gives the credit back.
+var holdTTL = 15 * time.Minute
+
+type reserveDocument struct {
+	Credits credit `json:"credits"`
+}
+
+type holdDocument struct {
+	HoldToken string   `json:"hold_token"`
+	Credits   credit   `json:"credits"`
+	ExpiresAt jsonTime `json:"expires_at"`
+}
+
+type commitDocument struct {
+	HoldToken string `json:"hold_token"`
+	Text      string `json:"text"`
+}
+
+type releaseDocument struct {
+	HoldToken string `json:"hold_token"`
+}
+
+func reserveHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+	if !hasMinCredit(w, r) {
+		return
+	}
+
+	rd := reserveDocument{Credits: textPrice}
+	if !decodeJSONBody(w, r, &rd) {
+		return
+	}
+	if rd.Credits <= 0 {
+		sendErrorMessage(w, "You must reserve some credit", http.StatusBadRequest)
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Failed to make a hold token: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to begin a transaction: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		withTables(`UPDATE {user} SET credit = credit - $1, version = version + 1 WHERE user_id = $2 AND credit >= $1`),
+		rd.Credits, userID,
+	)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to reserve credit for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		paymentRequired.add("", 1)
+		sendErrorMessage(w, "You don't have enough credit. Please pay us more money.", http.StatusPaymentRequired)
+		return
+	}
+
+	hd := holdDocument{HoldToken: token, Credits: rd.Credits}
+	err = tx.QueryRow(
+		withTables(`INSERT INTO {credit_hold} (hold_id, user_id, amount, expires_at)
+		      VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+		   RETURNING expires_at`),
+		sha256String(token), userID, rd.Credits, holdTTL.Seconds(),
+	).Scan(&hd.ExpiresAt)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to insert credit hold for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit credit hold for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, hd)
+}
+
+// errHoldTooSmall and errFinishHold end commitHandler's transaction. The
+// handler has already logged why finishHold failed.
+var (
+	errHoldTooSmall = errors.New("the hold doesn't cover the price of a text")
+	errFinishHold   = errors.New("could not finish the hold")
+)
+
+// commitHandler stores a text, paying for it out of a hold. Whatever is left
+// in the hold goes back to the user's balance.
+func commitHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+	if !hasMinCredit(w, r) {
+		return
+	}
+
+	var cd commitDocument
+	if !decodeJSONBody(w, r, &cd) {
+		return
+	}
+	hash := hashText(cd.Text)
+
+	// The text is stored in the same transaction that consumes the hold, so
+	// neither happens without the other. The transaction is tied to the
+	// request, so if the client goes away it's rolled back, like insertText.
+	var cost credit
+	err := withTx(r.Context(), func(tx *sql.Tx) error {
+		// Locking the hold means a concurrent commit or release of the same
+		// hold waits for us and then finds it gone.
+		var amount credit
+		err := tx.QueryRowContext(
+			r.Context(),
+			withTables(`SELECT amount FROM {credit_hold} WHERE hold_id = $1 AND user_id = $2 AND expires_at > now() FOR UPDATE`),
+			sha256String(cd.HoldToken), userID,
+		).Scan(&amount)
+		dbBreaker.recordContext(r.Context(), err)
+		if err != nil {
+			return err
+		}
+		// We don't know whether the text is new until we've stored it, so a
+		// hold has to cover the price even if the text turns out to be free.
+		if amount < textPrice {
+			return errHoldTooSmall
+		}
+
+		novel, err := storeText(r.Context(), tx, cd.Text, hash, userID, requestEntitlements(r).userByteQuota())
+		if err != nil {
+			return err
+		}
+		// Like POST /text, storing a text that's already stored is free.
+		if novel {
+			cost = textPrice
+		}
+		if !finishHold(tx, cd.HoldToken, userID, amount-cost) {
+			return errFinishHold
+		}
+		return nil
+	})
+	var overQuota *hashstore.QuotaError
+	switch {
+	case err == sql.ErrNoRows:
+		sendErrorMessage(w, "There is no such hold, or it has expired", http.StatusNotFound)
+		return
+	case err == errHoldTooSmall:
+		paymentRequired.add("", 1)
+		sendErrorMessage(w, "The hold doesn't cover the price of a text", http.StatusPaymentRequired)
+		return
+	case err == hashstore.ErrHashCollision:
+		sendErrorMessage(w, "A different text is already stored with this hash", http.StatusConflict)
+		return
+	case errors.As(err, &overQuota):
+		sendOverQuota(w, overQuota)
+		return
+	case err != nil:
+		log.Printf("Failed to commit credit hold for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	creditsDebited.add(metricsUser(userID), int64(cost))
+	recordUsage(userID, int64(len(cd.Text)), 0)
+
+	sendJSONResponse(w, hashDocument{Hash: hash})
+}
+
+func releaseHandler(w http.ResponseWriter, r *http.Request) {
+	userID := requestUserID(r)
+
+	var rd releaseDocument
+	if !decodeJSONBody(w, r, &rd) {
+		return
+	}
+
+	tx, err := db.Begin()
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to begin a transaction: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var amount credit
+	err = tx.QueryRow(
+		withTables(`SELECT amount FROM {credit_hold} WHERE hold_id = $1 AND user_id = $2 FOR UPDATE`),
+		sha256String(rd.HoldToken), userID,
+	).Scan(&amount)
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		sendErrorMessage(w, "There is no such hold", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Query to look up credit hold failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	if !finishHold(tx, rd.HoldToken, userID, amount) {
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit credit release for user_id = %s: %v", userID, err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishHold deletes the hold and gives refund credits back to the user.
+func finishHold(tx *sql.Tx, token, userID string, refund credit) bool {
+	_, err := tx.Exec(withTables(`DELETE FROM {credit_hold} WHERE hold_id = $1`), sha256String(token))
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to delete credit hold for user_id = %s: %v", userID, err)
+		return false
+	}
+
+	_, err = tx.Exec(withTables(`UPDATE {user} SET credit = credit + $1, version = version + 1 WHERE user_id = $2`), refund, userID)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to refund credit hold for user_id = %s: %v", userID, err)
+		return false
+	}
+
+	return true
+}
+
+// holdExpiryInterval is how often expired holds are given back.
+var holdExpiryInterval = time.Minute
+
+// holdExpirer runs expireHolds every holdExpiryInterval. It runs whether or
+// not the pruner does, as nobody else gives the credit in an expired hold
+// back.
+type holdExpirer struct {
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHoldExpirer(interval time.Duration) *holdExpirer {
+	return &holdExpirer{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (e *holdExpirer) start() {
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				expireHolds()
+			}
+		}
+	}()
+}
+
+// shutdown stops the expirer and waits for a run in progress to finish.
+func (e *holdExpirer) shutdown() {
+	close(e.stop)
+	<-e.done
+}
+
+// expireHolds gives the credit in every expired hold back to its user. It's
+// a single statement, so a hold can't be refunded without being deleted.
+func expireHolds() int64 {
+	res, err := db.Exec(
+		withTables(`WITH expired AS (
+		     DELETE FROM {credit_hold} WHERE expires_at <= now() RETURNING user_id, amount
+		 )
+		 UPDATE {user} u
+		    SET credit = credit + e.total, version = version + 1
+		   FROM (SELECT user_id, SUM(amount) AS total FROM expired GROUP BY user_id) e
+		  WHERE u.user_id = e.user_id`),
+	)
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Failed to expire credit holds: %v", err)
+		return 0
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("Failed to get the rows affected expiring credit holds: %v", err)
+		return 0
+	}
+	if n > 0 {
+		log.Printf("Refunded expired credit holds for %d users", n)
+	}
+	return n
+}
+
+// randomToken returns 32 random bytes as hex. We only store its SHA256 hash,
+// so the token itself is only ever seen by the client.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
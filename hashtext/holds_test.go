@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func holdRequest(path, userID, body string) (*http.Response, []byte) {
+	req := httptest.NewRequest("POST", "http://example.com"+path, bytes.NewBufferString(body))
+	req.Header.Set("X-HashText-User-ID", userID)
+	return fakeRequest(req, makeRouter().ServeHTTP)
+}
+
+func creditFor(t *testing.T, userID string) int64 {
+	var credit int64
+	err := db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID).Scan(&credit)
+	assert.Nil(t, err, "no error looking up credit")
+	return credit
+}
+
+func TestCreditHolds(t *testing.T) {
+	userID := sha256String("Xiomara")
+	start := creditFor(t, userID)
+
+	resp, body := holdRequest("/text/reserve", userID, `{"credits":5}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when reserving credit")
+
+	var hd holdDocument
+	err := json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, credit(5), hd.Credits, "reserved five credits")
+	assert.Equal(t, start-5, creditFor(t, userID), "reserved credit was taken out of the balance")
+
+	text := "test credit holds"
+	j, _ := json.Marshal(commitDocument{HoldToken: hd.HoldToken, Text: text})
+	resp, body = holdRequest("/text/commit", userID, string(j))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when committing a hold")
+
+	var hash hashDocument
+	err = json.Unmarshal(body, &hash)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String(text)}, hash, "got the hash for the text")
+	assert.Equal(t, start-1, creditFor(t, userID), "the rest of the hold was refunded after paying for the text")
+
+	resp, _ = holdRequest("/text/commit", userID, string(j))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "a hold can only be committed once")
+
+	resp, body = holdRequest("/text/reserve", userID, `{"credits":3}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when reserving credit")
+	err = json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+
+	resp, _ = holdRequest("/text/release", sha256String("Jane"), `{"hold_token":"`+hd.HoldToken+`"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "a user can't release someone else's hold")
+
+	resp, _ = holdRequest("/text/release", userID, `{"hold_token":"`+hd.HoldToken+`"}`)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "returned 204 when releasing a hold")
+	assert.Equal(t, start-1, creditFor(t, userID), "released credit was refunded")
+
+	resp, _ = holdRequest("/text/reserve", sha256String("Petra"), `{"credits":1}`)
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "returned 402 when reserving more credit than the user has")
+
+	resp, _ = holdRequest("/text/reserve", userID, `{"credits":0}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 when reserving no credit")
+}
+
+func TestCommitRecordsUsage(t *testing.T) {
+	flags.TrackUsage = true
+	defer func() { flags.TrackUsage = false }()
+	userID := sha256String("Henrietta")
+	execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, 'Henrietta', 10)`, userID)
+
+	resp, body := holdRequest("/text/reserve", userID, `{"credits":2}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when reserving credit")
+	var hd holdDocument
+	assert.Nil(t, json.Unmarshal(body, &hd), "no error unmarshalling response body")
+
+	text := "test commit records usage"
+	j, _ := json.Marshal(commitDocument{HoldToken: hd.HoldToken, Text: text})
+	resp, _ = holdRequest("/text/commit", userID, string(j))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 when committing a hold")
+	usageUpdates.Wait()
+
+	var ingested int64
+	err := db.QueryRow(`SELECT bytes_ingested FROM user_usage WHERE user_id = $1`, userID).Scan(&ingested)
+	assert.Nil(t, err, "no error looking up usage")
+	assert.Equal(t, int64(len(text)), ingested, "counted the committed text as ingested")
+}
+
+func TestExpireHolds(t *testing.T) {
+	userID := sha256String("Xiomara")
+	start := creditFor(t, userID)
+
+	_, err := db.Exec(`UPDATE "user" SET credit = credit - 7 WHERE user_id = $1`, userID)
+	assert.Nil(t, err, "took credit for the hold")
+	_, err = db.Exec(
+		`INSERT INTO credit_hold (hold_id, user_id, amount, expires_at) VALUES ($1, $2, 7, now() - interval '1 minute')`,
+		sha256String("expired hold"), userID,
+	)
+	assert.Nil(t, err, "inserted expired hold")
+
+	assert.Equal(t, int64(1), expireHolds(), "refunded one user")
+	assert.Equal(t, start, creditFor(t, userID), "expired hold was refunded")
+}
+
+func TestHoldExpirer(t *testing.T) {
+	userID := sha256String("Xiomara")
+	start := creditFor(t, userID)
+
+	_, err := db.Exec(`UPDATE "user" SET credit = credit - 3 WHERE user_id = $1`, userID)
+	assert.Nil(t, err, "took credit for the hold")
+	_, err = db.Exec(
+		`INSERT INTO credit_hold (hold_id, user_id, amount, expires_at) VALUES ($1, $2, 3, now() - interval '1 minute')`,
+		sha256String("hold for the expirer"), userID,
+	)
+	assert.Nil(t, err, "inserted expired hold")
+
+	e := newHoldExpirer(10 * time.Millisecond)
+	e.start()
+	deadline := time.Now().Add(5 * time.Second)
+	for creditFor(t, userID) != start && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.shutdown()
+	assert.Equal(t, start, creditFor(t, userID), "the expirer refunded the hold without the pruner")
+}
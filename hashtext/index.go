@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// indexHandler serves a short description of the service, so that someone
+// poking at the root URL gets something more useful than a 404.
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(indexHTML); err != nil {
+		log.Printf("Failed to write the response body: %v", err)
+	}
+}
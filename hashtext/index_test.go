@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for /")
+	assert.Equal(t, "text/html; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+	assert.Contains(t, string(body), "<h1>hashtext</h1>", "got the index page")
+
+	flags.DisableIndex = true
+	defer func() { flags.DisableIndex = false }()
+	resp, _ = fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for / when the index is disabled")
+}
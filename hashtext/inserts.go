@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// insertQueue stores submitted texts in the background with a fixed number of
+// workers. The queue is bounded so that a burst of submissions can't eat all
+// of our memory; when it's full, enqueue fails and the client is told to back
+// off.
+type insertQueue struct {
+	jobs chan insertJob
+	wg   sync.WaitGroup
+}
+
+type insertJob struct {
+	text   string
+	hash   string
+	userID string
+	quota  int64
+}
+
+func newInsertQueue(size int) *insertQueue {
+	return &insertQueue{jobs: make(chan insertJob, size)}
+}
+
+func (q *insertQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for job := range q.jobs {
+				// Like a synchronous insert, the text is stored and paid
+				// for in one transaction, and only if it's new. insertText
+				// logs its own errors, and there's nobody left to tell
+				// about them.
+				if _, err := insertText(context.Background(), job.text, job.hash, job.userID, job.quota); err != nil {
+					log.Printf("Async insert of hash = %s failed", job.hash)
+				}
+			}
+		}()
+	}
+}
+
+// enqueue returns false without blocking if the queue is full.
+func (q *insertQueue) enqueue(job insertJob) bool {
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops accepting jobs and waits for the workers to store everything
+// that's already queued.
+func (q *insertQueue) shutdown() {
+	close(q.jobs)
+	q.wg.Wait()
+}
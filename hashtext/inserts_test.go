@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextHandlerWithAsyncInserts(t *testing.T) {
+	// We don't start the workers until we've filled the queue, so the third
+	// submission is rejected.
+	inserts = newInsertQueue(2)
+	defer func() { inserts = nil }()
+
+	userID := sha256String("Jane")
+	start := creditFor(t, userID)
+	post := func(text string) (*http.Response, []byte) {
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString(text))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-HashText-User-ID", userID)
+		return fakeRequest(req, wrapHandler(textHandler))
+	}
+
+	hash := sha256String("test async insert one")
+	resp, body := post("test async insert one")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "returned 202 when the text was queued")
+	assert.Equal(t, "/text/"+hash, resp.Header.Get("Location"), "got the URL the text will be at")
+	assert.Equal(t, "", resp.Header.Get("X-HashText-Credit-Cost"), "the cost isn't known yet")
+	var hd hashDocument
+	err := json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: hash, Pending: true}, hd, "the response says the text is pending")
+
+	resp, _ = post("test async insert one")
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "returned 202 when the same text was queued again")
+	assert.Equal(t, start, creditFor(t, userID), "nothing was debited before the workers ran")
+
+	resp, _ = post("test async insert two")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "returned 429 when the queue is full")
+
+	inserts.start(2)
+	inserts.shutdown()
+
+	for text, stored := range map[string]int{"test async insert one": 1, "test async insert two": 0} {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, sha256String(text)).Scan(&count)
+		assert.Nil(t, err, "no error looking up hash_text")
+		assert.Equal(t, stored, count, "only the queued text was stored after draining the queue")
+	}
+	assert.Equal(t, start-1, creditFor(t, userID), "only the submission that stored the text was charged")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtAuthenticator accepts an "Authorization: Bearer <jwt>" header. The token
+// must be signed with HS256 using hmacSecret or with RS256 using publicKey,
+// must have an exp claim in the future, and its sub claim must be the user_id
+// of a known user.
+type jwtAuthenticator struct {
+	hmacSecret []byte
+	publicKey  *rsa.PublicKey
+	now        func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp *int64 `json:"exp"`
+	Nbf *int64 `json:"nbf"`
+}
+
+func (ja jwtAuthenticator) authenticate(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(auth, "Bearer "), ".")
+	if len(parts) != 3 {
+		return "", &authError{"malformed_token"}
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return "", &authError{"malformed_token"}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", &authError{"malformed_token"}
+	}
+	if aerr := ja.verify(header.Alg, parts[0]+"."+parts[1], signature); aerr != nil {
+		return "", aerr
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return "", &authError{"malformed_token"}
+	}
+
+	now := ja.now().Unix()
+	switch {
+	case claims.Exp == nil:
+		return "", &authError{"missing_expiry"}
+	case now >= *claims.Exp:
+		return "", &authError{"token_expired"}
+	case claims.Nbf != nil && now < *claims.Nbf:
+		return "", &authError{"token_not_yet_valid"}
+	case claims.Sub == "":
+		return "", &authError{"unknown_subject"}
+	}
+	exists, err := userExists(claims.Sub)
+	switch {
+	case err != nil:
+		return "", err
+	case !exists:
+		return "", &authError{"unknown_subject"}
+	}
+
+	return claims.Sub, nil
+}
+
+// verify checks the signature with whichever key we have for the token's
+// algorithm. We never trust the token to tell us it doesn't need verifying.
+func (ja jwtAuthenticator) verify(alg, signed string, signature []byte) *authError {
+	switch {
+	case alg == "HS256" && ja.hmacSecret != nil:
+		mac := hmac.New(sha256.New, ja.hmacSecret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return &authError{"invalid_signature"}
+		}
+	case alg == "RS256" && ja.publicKey != nil:
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(ja.publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return &authError{"invalid_signature"}
+		}
+	default:
+		return &authError{"unsupported_algorithm"}
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func readRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an RSA public key but got a %T", key)
+	}
+	return rsaKey, nil
+}
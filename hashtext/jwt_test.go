@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var jwtTestNow = time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+
+func makeJWT(alg string, claims map[string]interface{}, sign func(signed string) []byte) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hs256Signer(secret string) func(string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+func jwtRequest(token string) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/user/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	ja := jwtAuthenticator{hmacSecret: []byte("sekrit"), now: func() time.Time { return jwtTestNow }}
+	valid := map[string]interface{}{"sub": sha256String("Jane"), "exp": jwtTestNow.Add(time.Hour).Unix()}
+
+	userID, err := ja.authenticate(httptest.NewRequest("GET", "http://example.com/", nil))
+	assert.Equal(t, "", userID, "no user_id without an Authorization header")
+	assert.Nil(t, err, "no error without an Authorization header")
+
+	userID, err = ja.authenticate(jwtRequest(makeJWT("HS256", valid, hs256Signer("sekrit"))))
+	assert.Nil(t, err, "no error for a valid token")
+	assert.Equal(t, sha256String("Jane"), userID, "got the user_id from the sub claim")
+
+	expired := map[string]interface{}{"sub": sha256String("Jane"), "exp": jwtTestNow.Add(-time.Minute).Unix()}
+	_, err = ja.authenticate(jwtRequest(makeJWT("HS256", expired, hs256Signer("sekrit"))))
+	assert.Equal(t, &authError{"token_expired"}, err, "rejected an expired token")
+
+	_, err = ja.authenticate(jwtRequest(makeJWT("HS256", valid, hs256Signer("wrong secret"))))
+	assert.Equal(t, &authError{"invalid_signature"}, err, "rejected a token signed with the wrong secret")
+
+	token := makeJWT("HS256", valid, hs256Signer("sekrit"))
+	parts := strings.Split(token, ".")
+	c, _ := json.Marshal(map[string]interface{}{"sub": sha256String("Xiomara"), "exp": jwtTestNow.Add(time.Hour).Unix()})
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + parts[2]
+	_, err = ja.authenticate(jwtRequest(tampered))
+	assert.Equal(t, &authError{"invalid_signature"}, err, "rejected a token with tampered claims")
+
+	_, err = ja.authenticate(jwtRequest(makeJWT("none", valid, func(string) []byte { return nil })))
+	assert.Equal(t, &authError{"unsupported_algorithm"}, err, "rejected an unsigned token")
+
+	_, err = ja.authenticate(jwtRequest("not.a-token"))
+	assert.Equal(t, &authError{"malformed_token"}, err, "rejected a malformed token")
+
+	noExp := map[string]interface{}{"sub": sha256String("Jane")}
+	_, err = ja.authenticate(jwtRequest(makeJWT("HS256", noExp, hs256Signer("sekrit"))))
+	assert.Equal(t, &authError{"missing_expiry"}, err, "rejected a token without an exp claim")
+
+	unknown := map[string]interface{}{"sub": "nobody", "exp": jwtTestNow.Add(time.Hour).Unix()}
+	_, err = ja.authenticate(jwtRequest(makeJWT("HS256", unknown, hs256Signer("sekrit"))))
+	assert.Equal(t, &authError{"unknown_subject"}, err, "rejected a token for an unknown user")
+}
+
+func TestJWTAuthenticatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err, "generated an RSA key")
+	signer := func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return sig
+	}
+
+	ja := jwtAuthenticator{publicKey: &key.PublicKey, now: func() time.Time { return jwtTestNow }}
+	valid := map[string]interface{}{"sub": sha256String("Jane"), "exp": jwtTestNow.Add(time.Hour).Unix()}
+
+	userID, err := ja.authenticate(jwtRequest(makeJWT("RS256", valid, signer)))
+	assert.Nil(t, err, "no error for a valid token")
+	assert.Equal(t, sha256String("Jane"), userID, "got the user_id from the sub claim")
+
+	// A classic attack is to sign with HMAC using the public key as the
+	// secret. We have no HMAC secret configured, so this must be rejected.
+	_, err = ja.authenticate(jwtRequest(makeJWT("HS256", valid, hs256Signer("anything"))))
+	assert.Equal(t, &authError{"unsupported_algorithm"}, err, "rejected an HS256 token when only RS256 is configured")
+}
+
+func TestWrapHandlerWithJWT(t *testing.T) {
+	ja := jwtAuthenticator{hmacSecret: []byte("sekrit"), now: func() time.Time { return jwtTestNow }}
+	saved := authChain
+	authChain = []authenticator{headerAuthenticator{}, ja}
+	defer func() { authChain = saved }()
+
+	expired := map[string]interface{}{"sub": sha256String("Jane"), "exp": jwtTestNow.Add(-time.Minute).Unix()}
+	resp, body := fakeRequest(jwtRequest(makeJWT("HS256", expired, hs256Signer("sekrit"))), wrapHandler(userHandler))
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "returned 401 for an expired token")
+	assert.Equal(t, "token_expired", string(body), "got the reason code in the body")
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), `error_description="token_expired"`, "got the reason code in WWW-Authenticate")
+
+	valid := map[string]interface{}{"sub": sha256String("Jane"), "exp": jwtTestNow.Add(time.Hour).Unix()}
+	resp, _ = fakeRequest(jwtRequest(makeJWT("HS256", valid, hs256Signer("sekrit"))), wrapHandler(userHandler))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a valid token")
+}
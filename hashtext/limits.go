@@ -0,0 +1,49 @@
+package main
+
+import "net/http"
+
+// submittedTextTypes are the request body types readSubmittedText accepts.
+var submittedTextTypes = []string{"application/json", "text/plain", "multipart/form-data"}
+
+// limitsDocument describes the limits the server enforces, so that clients
+// don't have to hard code them. Zero means there is no limit. GlobalRate is
+// in requests per second across all clients.
+type limitsDocument struct {
+	MaxTextBytes       int64    `json:"max_text_bytes"`
+	MaxStreamBytes     int64    `json:"max_stream_bytes"`
+	UserByteQuota      int64    `json:"user_byte_quota"`
+	FreeTextsPerDay    int      `json:"free_texts_per_day"`
+	DefaultPageSize    int      `json:"default_page_size"`
+	MaxPageBytes       int64    `json:"max_page_bytes"`
+	AsyncInsertQueue   int      `json:"async_insert_queue"`
+	GlobalRate         float64  `json:"global_rate"`
+	GlobalBurst        int      `json:"global_burst"`
+	MaxConcurrentPerIP int      `json:"max_concurrent_per_ip"`
+	SubmittedTextTypes []string `json:"submitted_text_types"`
+}
+
+// limitsHandler reports the same values the handlers check, so it can't drift
+// from what the server actually enforces. It needs neither authorization nor
+// credit.
+func limitsHandler(w http.ResponseWriter, r *http.Request) {
+	ld := limitsDocument{
+		MaxTextBytes:       maxTextBytes,
+		MaxStreamBytes:     maxStreamBytes,
+		UserByteQuota:      userByteQuota,
+		FreeTextsPerDay:    flags.FreeTextsPerDay,
+		DefaultPageSize:    defaultPageSize,
+		MaxPageBytes:       maxPageBytes,
+		SubmittedTextTypes: submittedTextTypes,
+	}
+	if flags.asyncInserts() {
+		ld.AsyncInsertQueue = flags.AsyncInsertQueue
+	}
+	if globalLimiter != nil {
+		ld.GlobalRate = globalLimiter.rate
+		ld.GlobalBurst = int(globalLimiter.burst)
+	}
+	if ipLimiter != nil {
+		ld.MaxConcurrentPerIP = ipLimiter.max
+	}
+	sendJSONResponse(w, ld)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsHandler(t *testing.T) {
+	saved := maxTextBytes
+	maxTextBytes = 1024
+	defer func() { maxTextBytes = saved }()
+	flags.FreeTextsPerDay = 5
+	defer func() { flags.FreeTextsPerDay = 0 }()
+
+	req := httptest.NewRequest("GET", "http://example.com/limits", nil)
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without authentication")
+
+	var ld limitsDocument
+	err := json.Unmarshal(body, &ld)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, limitsDocument{
+		MaxTextBytes:       1024,
+		MaxStreamBytes:     maxStreamBytes,
+		FreeTextsPerDay:    5,
+		DefaultPageSize:    defaultPageSize,
+		MaxPageBytes:       maxPageBytes,
+		SubmittedTextTypes: []string{"application/json", "text/plain", "multipart/form-data"},
+	}, ld, "got the configured limits")
+}
+
+func TestLimitsHandlerRateLimits(t *testing.T) {
+	globalLimiter = newTokenBucket(2.5, 10)
+	ipLimiter = newIPConcurrencyLimiter(4)
+	defer func() {
+		globalLimiter = nil
+		ipLimiter = nil
+	}()
+
+	req := httptest.NewRequest("GET", "http://example.com/limits", nil)
+	resp, body := fakeRequest(req, makeRouter().ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200")
+
+	var ld limitsDocument
+	err := json.Unmarshal(body, &ld)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, 2.5, ld.GlobalRate, "reported the global rate")
+	assert.Equal(t, 10, ld.GlobalBurst, "reported the global burst")
+	assert.Equal(t, 4, ld.MaxConcurrentPerIP, "reported the per-IP concurrency cap")
+}
@@ -1,23 +1,420 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+	"github.com/lib/pq"
 )
 
 var db *sql.DB
 
+// readDB is used for queries that can tolerate replication lag. It's the same
+// pool as db unless a read replica is configured.
+var readDB *sql.DB
+
+// maxTextBytes is the largest request body we'll read when a client submits
+// a text.
+var maxTextBytes int64 = 1 << 20
+
+// maxStreamBytes is the largest request body POST /hash/stream will hash.
+// The body is never held in memory, so this can be much larger than
+// maxTextBytes.
+var maxStreamBytes int64 = 1 << 30
+
+// userByteQuota is the most text, in bytes, that a user can have stored at
+// once. Zero means there is no limit.
+var userByteQuota int64
+
+// debitLocks serializes submissions per user inside the app, so that they
+// don't queue up on the user's row in Postgres. It is nil, and therefore a
+// no-op, unless HASHTEXT_SERIALIZE_USER_DEBITS is set.
+var debitLocks *userLocks
+
+// inserts stores submitted texts in the background. It is nil, and texts are
+// stored before we respond, unless HASHTEXT_ASYNC_INSERT_WORKERS is set.
+var inserts *insertQueue
+
+// dbBreaker fast-fails requests while the database is failing. It is nil, and
+// therefore always closed, unless HASHTEXT_BREAKER_THRESHOLD is set.
+var dbBreaker *circuitBreaker
+
 func main() {
+	// The flags are parsed first, as some of them change how we connect to
+	// the database.
+	var err error
+	flags, err = parseFlags(os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if t := os.Getenv("HASHTEXT_SLOW_QUERY_THRESHOLD"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d < 0 {
+			log.Fatalf("HASHTEXT_SLOW_QUERY_THRESHOLD must be a non-negative duration, not %q", t)
+		}
+		slowQueryThreshold = d
+	}
+
+	if prefix := os.Getenv("HASHTEXT_TABLE_PREFIX"); prefix != "" {
+		t, err := hashstore.NewTableNames(prefix)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_TABLE_PREFIX: %v", err)
+		}
+		setTableNames(t)
+	}
+	if sp := os.Getenv("HASHTEXT_SEARCH_PATH"); sp != "" {
+		if err := hashstore.CheckSchemaName(sp); err != nil {
+			log.Fatalf("Invalid HASHTEXT_SEARCH_PATH: %v", err)
+		}
+		searchPath = sp
+	}
+
 	db = openDB()
 	defer db.Close()
+	readDB = openReadDB(db)
+	if readDB != db {
+		defer readDB.Close()
+	}
+
+	adminUserIDs = parseAdminUserIDs(os.Getenv("HASHTEXT_ADMIN_USER_IDS"))
+	if ja, ok := jwtAuthenticatorFromEnv(); ok {
+		authenticators["jwt"] = ja
+		authChain = append(authChain, ja)
+	}
+	var tlsConfig *tls.Config
+	if caFile := os.Getenv("HASHTEXT_TLS_CLIENT_CA_FILE"); caFile != "" {
+		var err error
+		tlsConfig, err = clientCATLSConfig(caFile)
+		if err != nil {
+			log.Fatalf("Could not load the client CAs from %s: %v", caFile, err)
+		}
+		ma := mtlsAuthenticator{}
+		if m := os.Getenv("HASHTEXT_MTLS_USER_MAP"); m != "" {
+			ma.users, err = parseMTLSUserMap(m)
+			if err != nil {
+				log.Fatalf("Invalid HASHTEXT_MTLS_USER_MAP: %v", err)
+			}
+		}
+		authenticators["mtls"] = ma
+		authChain = append([]authenticator{ma}, authChain...)
+	}
+	if chain := os.Getenv("HASHTEXT_AUTH_CHAIN"); chain != "" {
+		var err error
+		authChain, err = parseAuthChain(chain)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_AUTH_CHAIN %q: %v", chain, err)
+		}
+	}
+	if ra := os.Getenv("HASHTEXT_ROUTE_AUTH"); ra != "" {
+		var err error
+		routeAuth, err = parseRouteAuth(ra)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_ROUTE_AUTH %q: %v", ra, err)
+		}
+	}
+	if !flags.creditEnabled() {
+		log.Print("Credit enforcement is disabled")
+	}
+	if flags.DevUser != "" {
+		log.Printf("WARNING: HASHTEXT_DEV_USER is set. Requests without credentials are treated as coming from user_id = %s. Never do this in production!", flags.DevUser)
+		authChain = append(authChain, devUserAuthenticator{userID: flags.DevUser})
+	}
+	if max := os.Getenv("HASHTEXT_MAX_TEXT_BYTES"); max != "" {
+		n, err := strconv.ParseInt(max, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("HASHTEXT_MAX_TEXT_BYTES must be a positive integer, not %q", max)
+		}
+		maxTextBytes = n
+	}
+	if max := os.Getenv("HASHTEXT_MAX_STREAM_BYTES"); max != "" {
+		n, err := strconv.ParseInt(max, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("HASHTEXT_MAX_STREAM_BYTES must be a positive integer, not %q", max)
+		}
+		maxStreamBytes = n
+	}
+	if size := os.Getenv("HASHTEXT_DEFAULT_PAGE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 || n > maxPageSize {
+			log.Fatalf("HASHTEXT_DEFAULT_PAGE_SIZE must be an integer from 1 to %d, not %q", maxPageSize, size)
+		}
+		defaultPageSize = n
+	}
+	if max := os.Getenv("HASHTEXT_MAX_PAGE_BYTES"); max != "" {
+		n, err := strconv.ParseInt(max, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("HASHTEXT_MAX_PAGE_BYTES must be a positive integer, not %q", max)
+		}
+		maxPageBytes = n
+	}
+	if quota := os.Getenv("HASHTEXT_USER_BYTE_QUOTA"); quota != "" {
+		n, err := strconv.ParseInt(quota, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("HASHTEXT_USER_BYTE_QUOTA must be a non-negative integer, not %q", quota)
+		}
+		userByteQuota = n
+	}
+	// The share and self-test routes only exist when they're configured, so
+	// this has to come before we check HASHTEXT_DISABLED_ROUTES against the
+	// routes.
+	if secret := os.Getenv("HASHTEXT_SHARE_SECRET"); secret != "" {
+		shareSecret = []byte(secret)
+	}
+	if ttl := os.Getenv("HASHTEXT_SHARE_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("HASHTEXT_SHARE_TTL must be a positive duration, not %q", ttl)
+		}
+		shareTTL = d
+	}
+	selftestUserID = os.Getenv("HASHTEXT_SELFTEST_USER_ID")
+	if dr := os.Getenv("HASHTEXT_DISABLED_ROUTES"); dr != "" {
+		disabledRoutes, err = parseDisabledRoutes(dr, routeNames(makeRouter()))
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_DISABLED_ROUTES %q: %v", dr, err)
+		}
+		log.Printf("Routes disabled: %s", dr)
+	}
+	if flags.MetricsPerUser {
+		labelCreditsByUser()
+	}
+	if flags.MoneyCredit {
+		if err := checkMoneyColumns(); err != nil {
+			log.Fatal(err)
+		}
+		textPrice = moneyScale
+	}
+	if price := os.Getenv("HASHTEXT_TEXT_PRICE"); price != "" {
+		c, err := parseCredit(price)
+		if err != nil || c <= 0 {
+			log.Fatalf("HASHTEXT_TEXT_PRICE must be a positive amount, not %q", price)
+		}
+		textPrice = c
+	}
+	if flags.SerializeUserDebits {
+		debitLocks = newUserLocks()
+	}
+
+	if threshold := os.Getenv("HASHTEXT_BREAKER_THRESHOLD"); threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n <= 0 {
+			log.Fatalf("HASHTEXT_BREAKER_THRESHOLD must be a positive integer, not %q", threshold)
+		}
+		cooldown := 30 * time.Second
+		if c := os.Getenv("HASHTEXT_BREAKER_COOLDOWN"); c != "" {
+			cooldown, err = time.ParseDuration(c)
+			if err != nil || cooldown <= 0 {
+				log.Fatalf("HASHTEXT_BREAKER_COOLDOWN must be a positive duration, not %q", c)
+			}
+		}
+		dbBreaker = newCircuitBreaker(n, cooldown)
+	}
+
+	if rate := os.Getenv("HASHTEXT_GLOBAL_RATE"); rate != "" {
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			log.Fatalf("HASHTEXT_GLOBAL_RATE must be a positive number, not %q", rate)
+		}
+		burst := int(math.Ceil(r))
+		if b := os.Getenv("HASHTEXT_GLOBAL_BURST"); b != "" {
+			burst, err = strconv.Atoi(b)
+			if err != nil || burst <= 0 {
+				log.Fatalf("HASHTEXT_GLOBAL_BURST must be a positive integer, not %q", b)
+			}
+		}
+		globalLimiter = newTokenBucket(r, burst)
+	}
+
+	if cidrs := os.Getenv("HASHTEXT_TRUSTED_CIDRS"); cidrs != "" {
+		trustedCIDRs, err = parseCIDRs(cidrs)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_TRUSTED_CIDRS: %v", err)
+		}
+	}
+	if max := os.Getenv("HASHTEXT_MAX_CONCURRENT_PER_IP"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n <= 0 {
+			log.Fatalf("HASHTEXT_MAX_CONCURRENT_PER_IP must be a positive integer, not %q", max)
+		}
+		ipLimiter = newIPConcurrencyLimiter(n)
+	}
+
+	if flags.asyncInserts() {
+		inserts = newInsertQueue(flags.AsyncInsertQueue)
+		inserts.start(flags.AsyncInsertWorkers)
+	}
+
+	for name, env := range map[string]string{
+		"X-Content-Type-Options": "HASHTEXT_CONTENT_TYPE_OPTIONS",
+		"X-Frame-Options":        "HASHTEXT_FRAME_OPTIONS",
+	} {
+		if value, ok := os.LookupEnv(env); ok {
+			securityHeaders[name] = value
+		}
+	}
+	if value, ok := os.LookupEnv("HASHTEXT_HSTS"); ok {
+		hstsHeader = value
+	}
+	serviceNotice = os.Getenv("HASHTEXT_NOTICE")
+
+	if enc := os.Getenv("HASHTEXT_DIGEST_ENCODING"); enc != "" {
+		de, err := hashstore.ParseDigestEncoding(enc)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_DIGEST_ENCODING: %v", err)
+		}
+		textDigest = de
+	}
+
+	if tf := os.Getenv("HASHTEXT_TIME_FORMAT"); tf != "" {
+		layout, err := parseTimeFormat(tf)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_TIME_FORMAT: %v", err)
+		}
+		timeLayout = layout
+	}
+	if tz := os.Getenv("HASHTEXT_TIME_ZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("Invalid HASHTEXT_TIME_ZONE: %v", err)
+		}
+		timeLocation = loc
+	}
+
+	if ttl := os.Getenv("HASHTEXT_HOLD_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			log.Fatalf("HASHTEXT_HOLD_TTL must be a positive duration, not %q", ttl)
+		}
+		holdTTL = d
+	}
+	if interval := os.Getenv("HASHTEXT_HOLD_EXPIRY_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("HASHTEXT_HOLD_EXPIRY_INTERVAL must be a positive duration, not %q", interval)
+		}
+		holdExpiryInterval = d
+	}
+	expirer := newHoldExpirer(holdExpiryInterval)
+	expirer.start()
+
+	var p *pruner
+	if interval := os.Getenv("HASHTEXT_PRUNE_INTERVAL"); interval != "" {
+		i, err := time.ParseDuration(interval)
+		if err != nil || i <= 0 {
+			log.Fatalf("HASHTEXT_PRUNE_INTERVAL must be a positive duration, not %q", interval)
+		}
+		retention := 90 * 24 * time.Hour
+		if r := os.Getenv("HASHTEXT_PRUNE_RETENTION"); r != "" {
+			retention, err = time.ParseDuration(r)
+			if err != nil || retention <= 0 {
+				log.Fatalf("HASHTEXT_PRUNE_RETENTION must be a positive duration, not %q", r)
+			}
+		}
+		p = newPruner(i, retention)
+		p.start()
+	}
 
-	r := makeRouter()
-	http.Handle("/", r)
+	addr := os.Getenv("HASHTEXT_LISTEN")
+	if addr == "" {
+		addr = ":8080"
+	}
+	certFile := os.Getenv("HASHTEXT_TLS_CERT_FILE")
+	keyFile := os.Getenv("HASHTEXT_TLS_KEY_FILE")
+	if tlsConfig != nil && certFile == "" {
+		log.Fatal("HASHTEXT_TLS_CLIENT_CA_FILE requires HASHTEXT_TLS_CERT_FILE and HASHTEXT_TLS_KEY_FILE")
+	}
+	var prestopDelay time.Duration
+	if d := os.Getenv("HASHTEXT_PRESTOP_DELAY"); d != "" {
+		prestopDelay, err = time.ParseDuration(d)
+		if err != nil || prestopDelay < 0 {
+			log.Fatalf("HASHTEXT_PRESTOP_DELAY must be a non-negative duration, not %q", d)
+		}
+	}
+	// Zero leaves Go's default of http.DefaultMaxHeaderBytes.
+	var maxHeaderBytes int
+	if max := os.Getenv("HASHTEXT_MAX_HEADER_BYTES"); max != "" {
+		maxHeaderBytes, err = strconv.Atoi(max)
+		if err != nil || maxHeaderBytes <= 0 {
+			log.Fatalf("HASHTEXT_MAX_HEADER_BYTES must be a positive integer, not %q", max)
+		}
+	}
+	server := &http.Server{Addr: addr, Handler: makeRouter(), TLSConfig: tlsConfig, MaxHeaderBytes: maxHeaderBytes}
+	if flags.DisableKeepAlives {
+		log.Print("HTTP keep-alives are disabled")
+		server.SetKeepAlivesEnabled(false)
+	}
+	go func() {
+		var err error
+		if certFile != "" {
+			log.Printf("Listening on %s with TLS", addr)
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			log.Printf("Listening on %s", addr)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	draining.Store(true)
+	// Load balancers only notice that /readyz is failing the next time they
+	// check it, so keep serving whatever they still send us until then. A
+	// second signal skips the wait.
+	if prestopDelay > 0 {
+		log.Printf("Draining for %s before shutting down", prestopDelay)
+		select {
+		case <-time.After(prestopDelay):
+		case <-stop:
+		}
+	}
+	log.Print("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down the server: %v", err)
+	}
+	if inserts != nil {
+		inserts.shutdown()
+	}
+	if p != nil {
+		p.shutdown()
+	}
+	expirer.shutdown()
+}
+
+// jwtAuthenticatorFromEnv returns a JWT authenticator if either
+// HASHTEXT_JWT_HMAC_SECRET or HASHTEXT_JWT_PUBLIC_KEY_FILE is set.
+func jwtAuthenticatorFromEnv() (jwtAuthenticator, bool) {
+	ja := jwtAuthenticator{now: time.Now}
+	if secret := os.Getenv("HASHTEXT_JWT_HMAC_SECRET"); secret != "" {
+		ja.hmacSecret = []byte(secret)
+	}
+	if file := os.Getenv("HASHTEXT_JWT_PUBLIC_KEY_FILE"); file != "" {
+		key, err := readRSAPublicKey(file)
+		if err != nil {
+			log.Fatalf("Could not read the JWT public key from %s: %v", file, err)
+		}
+		ja.publicKey = key
+	}
+	return ja, ja.hmacSecret != nil || ja.publicKey != nil
 }
 
 func openDB() *sql.DB {
@@ -25,10 +422,91 @@ func openDB() *sql.DB {
 	if dbName == "" {
 		dbName = "hashtext"
 	}
-	db, err := sql.Open("postgres", fmt.Sprintf("user=hashtext password=hashtext dbname=%s host=127.0.0.1", dbName))
+	return connectDB(primaryDSN(dbName), fmt.Sprintf("the %s database as user hashtext", dbName))
+}
+
+func primaryDSN(dbName string) string {
+	dsn := fmt.Sprintf(
+		"user=hashtext password=hashtext dbname=%s host=127.0.0.1 application_name=%s",
+		dbName, quoteDSNValue(applicationName()),
+	)
+	// lib/pq sends parameters it doesn't know itself to Postgres, which sets
+	// search_path for the session.
+	if searchPath != "public" {
+		dsn += " search_path=" + quoteDSNValue(searchPath)
+	}
+	// PgBouncer in transaction pooling mode can hand each round trip to a
+	// different server connection, so a statement prepared in one may not
+	// exist when we go to run it in the next. With binary_parameters lib/pq
+	// sends the parse, bind, and execute for a query all at once instead.
+	if flags.PgBouncer {
+		dsn += " binary_parameters=yes"
+	}
+	return dsn
+}
+
+// openReadDB opens the pool used for read-only queries. If HASHTEXT_READ_DSN
+// isn't set, reads go to the primary like everything else.
+func openReadDB(primary *sql.DB) *sql.DB {
+	dsn := os.Getenv("HASHTEXT_READ_DSN")
+	if dsn == "" {
+		return primary
+	}
+	return connectDB(dsn, "the read replica")
+}
+
+func connectDB(dsn, description string) *sql.DB {
+	connector, err := pq.NewConnector(dsn)
 	if err != nil {
-		log.Fatalf("Error connecting to the %s database as user hashtext: %v", dbName, err)
+		log.Fatalf("Error connecting to %s: %v", description, err)
+	}
+	db := sql.OpenDB(timedConnector{connector})
+
+	// sql.OpenDB doesn't actually connect. During a rolling deploy the database
+	// may be briefly unavailable, so we keep trying for a while rather than
+	// dying right away and getting restarted over and over.
+	wait := 30 * time.Second
+	if w := os.Getenv("HASHTEXT_DB_CONNECT_TIMEOUT"); w != "" {
+		wait, err = time.ParseDuration(w)
+		if err != nil || wait < 0 {
+			log.Fatalf("HASHTEXT_DB_CONNECT_TIMEOUT must be a non-negative duration, not %q", w)
+		}
+	}
+	deadline := time.Now().Add(wait)
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = db.Ping()
+		if err == nil {
+			break
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			log.Fatalf("Error connecting to %s after %d attempts: %v", description, attempt, err)
+		}
+		log.Printf("Attempt %d to connect to %s failed, retrying in %s: %v", attempt, description, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
 	}
 
 	return db
 }
+
+// applicationName is what our connections show up as in pg_stat_activity. It
+// includes the hostname by default so that we can tell which instance (or
+// pod) a connection belongs to.
+func applicationName() string {
+	if name := os.Getenv("HASHTEXT_APPLICATION_NAME"); name != "" {
+		return name
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "hashtext"
+	}
+	return "hashtext@" + host
+}
+
+func quoteDSNValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrimaryDSN(t *testing.T) {
+	os.Setenv("HASHTEXT_APPLICATION_NAME", "hashtext-test")
+	defer os.Unsetenv("HASHTEXT_APPLICATION_NAME")
+
+	saved := flags.PgBouncer
+	defer func() { flags.PgBouncer = saved }()
+
+	flags.PgBouncer = false
+	assert.Equal(t,
+		"user=hashtext password=hashtext dbname=hashtext host=127.0.0.1 application_name='hashtext-test'",
+		primaryDSN("hashtext"), "got the default DSN")
+
+	flags.PgBouncer = true
+	assert.Equal(t,
+		"user=hashtext password=hashtext dbname=hashtext host=127.0.0.1 application_name='hashtext-test' binary_parameters=yes",
+		primaryDSN("hashtext"), "turned on binary_parameters for PgBouncer")
+
+	flags.PgBouncer = false
+	searchPath = "tenant_1"
+	defer func() { searchPath = "public" }()
+	assert.Equal(t,
+		"user=hashtext password=hashtext dbname=hashtext host=127.0.0.1 application_name='hashtext-test' search_path='tenant_1'",
+		primaryDSN("hashtext"), "set search_path for a schema other than public")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A counter is a Prometheus counter with at most one label. We write the
+// text exposition format ourselves rather than pull in the Prometheus client
+// for a handful of counters.
+type counter struct {
+	name  string
+	help  string
+	label string
+	// format writes a value. Values are written as integers without it.
+	format func(int64) string
+
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{name: name, help: help, label: label, values: map[string]int64{}}
+}
+
+// withFormat sets how the counter's values are written.
+func (c *counter) withFormat(format func(int64) string) *counter {
+	c.format = format
+	return c
+}
+
+// add adds n to the counter. labelValue is ignored by a counter without a
+// label.
+func (c *counter) add(labelValue string, n int64) {
+	if c.label == "" {
+		labelValue = ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += n
+}
+
+// get returns the counter's value for labelValue.
+func (c *counter) get(labelValue string) int64 {
+	if c.label == "" {
+		labelValue = ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, c.value(c.values[""]))
+		return
+	}
+	labelValues := make([]string, 0, len(c.values))
+	for lv := range c.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, lv, c.value(c.values[lv]))
+	}
+}
+
+func (c *counter) value(n int64) string {
+	if c.format == nil {
+		return strconv.FormatInt(n, 10)
+	}
+	return c.format(n)
+}
+
+// A histogram is a Prometheus histogram without labels. buckets are the
+// upper bounds, in ascending order, and counts[i] is how many observations
+// fell in bucket i alone. write makes them cumulative, as Prometheus expects.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative int64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// A metric is a counter or a histogram.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	creditsDebited  = newCounter("credits_debited_total", "Credits debited for submitted texts.", "").withFormat(formatCredit)
+	textsStored     = newCounter("texts_stored_total", "Submitted texts that were new and stored.", "")
+	textsDuplicate  = newCounter("texts_duplicate_total", "Submitted texts that were already stored.", "")
+	paymentRequired = newCounter("payment_required_total", "Submissions rejected with a 402 for lack of credit.", "")
+	// replicaFallbacks counts the reads that failed on the replica and were
+	// retried on the primary. GET /admin/stats reports it too.
+	replicaFallbacks = newCounter("replica_fallbacks_total", "Reads that failed on the replica and were retried on the primary.", "")
+	// queryDuration is timed at the driver, like the slow query log.
+	queryDuration = newHistogram(
+		"query_duration_seconds", "How long database queries took.",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	)
+)
+
+// metrics is every metric, in the order GET /metrics writes them.
+var metrics = []metric{creditsDebited, textsStored, textsDuplicate, paymentRequired, replicaFallbacks, queryDuration}
+
+// formatCredit writes an amount of credit, which in money mode is in
+// hundredths, as a whole amount.
+func formatCredit(n int64) string {
+	return credit(n).String()
+}
+
+// labelCreditsByUser adds a user label to credits_debited_total. Every user
+// gets their own series, so this is only for deployments with few users.
+func labelCreditsByUser() {
+	creditsDebited.label = "user"
+}
+
+// metricsUser is the user label value for a user_id. A user_id can be a
+// credential, so we never expose it, only a short hash of it.
+func metricsUser(userID string) string {
+	return sha256String(userID)[:16]
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=UTF-8")
+	io.WriteString(w, b.String())
+}
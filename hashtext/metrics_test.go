@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	c := newCounter("things_total", "Things.", "")
+	c.add("ignored", 2)
+	c.add("", 3)
+	var b strings.Builder
+	c.write(&b)
+	assert.Equal(t, "# HELP things_total Things.\n# TYPE things_total counter\nthings_total 5\n", b.String(), "wrote an unlabelled counter")
+
+	c = newCounter("things_total", "Things.", "user")
+	c.add("b", 1)
+	c.add("a", 2)
+	c.add("b", 1)
+	b.Reset()
+	c.write(&b)
+	assert.Equal(t,
+		"# HELP things_total Things.\n# TYPE things_total counter\nthings_total{user=\"a\"} 2\nthings_total{user=\"b\"} 2\n",
+		b.String(),
+		"wrote a labelled counter sorted by label value",
+	)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	flags.Metrics = true
+	defer func() { flags.Metrics = false }()
+
+	paymentRequired.add("", 1)
+	req := httptest.NewRequest("GET", "http://example.com/metrics", nil)
+	resp, body := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 without credentials")
+	assert.Equal(t, "text/plain; version=0.0.4; charset=UTF-8", resp.Header.Get("Content-Type"), "got the Prometheus content type")
+	for _, name := range []string{"credits_debited_total", "texts_stored_total", "texts_duplicate_total", "payment_required_total", "replica_fallbacks_total"} {
+		assert.Contains(t, string(body), "# TYPE "+name+" counter\n", "got %s", name)
+	}
+	assert.Contains(t, string(body), "# TYPE query_duration_seconds histogram\n", "got query_duration_seconds")
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("wait_seconds", "Waits.", []float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(0.5)
+	h.observe(2)
+	var b strings.Builder
+	h.write(&b)
+	assert.Equal(t,
+		"# HELP wait_seconds Waits.\n# TYPE wait_seconds histogram\n"+
+			"wait_seconds_bucket{le=\"0.1\"} 1\n"+
+			"wait_seconds_bucket{le=\"1\"} 3\n"+
+			"wait_seconds_bucket{le=\"+Inf\"} 4\n"+
+			"wait_seconds_sum 3.05\n"+
+			"wait_seconds_count 4\n",
+		b.String(),
+		"wrote cumulative buckets",
+	)
+}
+
+func TestMetricsUser(t *testing.T) {
+	userID := sha256String("Jane")
+	assert.Len(t, metricsUser(userID), 16, "got a short label")
+	assert.False(t, strings.HasPrefix(userID, metricsUser(userID)), "the label isn't the start of the user_id")
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// recoverMiddleware turns a panic in a handler into a 500 response instead of
+// letting it take down the whole server. If the handler had already started
+// its response, like a stream or a file, the 500 would only garble it, so the
+// client just gets what was written before the panic. http.ErrAbortHandler is
+// passed on, since it's how a handler asks net/http to drop the connection.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &startedResponseWriter{ResponseWriter: rw}
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s (request ID %s): %v\n%s", r.Method, r.URL.Path, requestID(r), err, debug.Stack())
+				if w.started {
+					return
+				}
+				if flags.problemErrors() {
+					sendStatus(w, http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, `{"error":"Internal server error"}`)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startedResponseWriter notes whether a response has been started, so that
+// recoverMiddleware knows whether it can still send one of its own.
+type startedResponseWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedResponseWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startedResponseWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes on flushes, which streaming handlers rely on.
+func (w *startedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *startedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// securityHeaders are added to every response. Each of them can be changed
+// with an environment variable, or dropped by setting it to an empty string.
+var securityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "DENY",
+}
+
+// hstsHeader is the Strict-Transport-Security header we send. Browsers ignore
+// it over plain HTTP, so we only send it on TLS connections.
+var hstsHeader = "max-age=31536000"
+
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range securityHeaders {
+			if value != "" {
+				w.Header().Set(name, value)
+			}
+		}
+		if r.TLS != nil && hstsHeader != "" {
+			w.Header().Set("Strict-Transport-Security", hstsHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gunzipMiddleware decompresses request bodies sent with Content-Encoding:
+// gzip. Handlers apply their size limits to what they read from r.Body, so
+// those limits apply to the decompressed text and a small gzip bomb can't make
+// us read more than maxTextBytes.
+func gunzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			sendErrorMessage(w, "Could not decompress the gzip request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = gzipBody{zr: zr, body: r.Body}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+type gzipBody struct {
+	zr   *gzip.Reader
+	body io.ReadCloser
+}
+
+// Read marks any error other than io.EOF as a *gzipError, so that handlers can
+// tell a corrupt body, which is the client's fault, from other errors.
+func (b gzipBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = &gzipError{err}
+	}
+	return n, err
+}
+
+func (b gzipBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
+
+type gzipError struct {
+	err error
+}
+
+func (e *gzipError) Error() string {
+	return "reading gzip request body: " + e.err.Error()
+}
+
+func (e *gzipError) Unwrap() error {
+	return e.err
+}
+
+// serviceNotice is a message for clients, like a warning about planned
+// maintenance. When it's set it's sent in an X-HashText-Notice header on every
+// response, and added to JSON object responses as a notice key.
+var serviceNotice string
+
+func noticeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serviceNotice != "" {
+			w.Header().Set("X-HashText-Notice", serviceNotice)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDMiddleware sends the request's X-Request-ID back in the response,
+// so that a client can match a response to the request it logged, and so that
+// problem details can name the request.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get("X-Request-ID"); id != "" {
+			w.Header().Set("X-Request-ID", id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the ID that the client or a proxy in front of us assigned
+// to this request, or "-" if there isn't one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		return "-"
+	}
+	return id
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	r := makeRouter()
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("oh no") })
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+	req := httptest.NewRequest("GET", "http://example.com/panic", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	resp, body := fakeRequest(req, r.ServeHTTP)
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "returned 500 when the handler panics")
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"), "got expected Content-Type in response")
+	assert.Equal(t, `{"error":"Internal server error"}`, string(body), "got expected error in body")
+
+	req = httptest.NewRequest("GET", "http://example.com/ok", nil)
+	resp, body = fakeRequest(req, r.ServeHTTP)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "router still serves requests after a panic")
+	assert.Equal(t, "ok", string(body), "got expected body after a panic")
+}
+
+func TestRecoverMiddlewareAfterWrite(t *testing.T) {
+	r := makeRouter()
+	r.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic("oh no")
+	})
+	r.HandleFunc("/abort", func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) })
+
+	req := httptest.NewRequest("GET", "http://example.com/partial", nil)
+	resp, body := fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "kept the status the handler already sent")
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"), "kept the handler's Content-Type")
+	assert.Equal(t, "partial", string(body), "didn't add an error to the partial body")
+
+	req = httptest.NewRequest("GET", "http://example.com/abort", nil)
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { fakeRequest(req, r.ServeHTTP) }, "passed on http.ErrAbortHandler")
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	r := makeRouter()
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+	for _, path := range []string{"/ok", "/no/such/route"} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		resp, _ := fakeRequest(req, r.ServeHTTP)
+		assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"), "got X-Content-Type-Options for %s", path)
+		assert.Equal(t, "DENY", resp.Header.Get("X-Frame-Options"), "got X-Frame-Options for %s", path)
+		assert.Equal(t, "", resp.Header.Get("Strict-Transport-Security"), "no HSTS without TLS for %s", path)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/livez", nil)
+	resp, _ := fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode, "returned 405 for the wrong method")
+	assert.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"), "got X-Content-Type-Options on a 405")
+
+	req = httptest.NewRequest("GET", "https://example.com/ok", nil)
+	req.TLS = &tls.ConnectionState{}
+	resp, _ = fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, hstsHeader, resp.Header.Get("Strict-Transport-Security"), "got HSTS over TLS")
+}
+
+func TestGunzipMiddleware(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		io.WriteString(zw, s)
+		zw.Close()
+		return b.Bytes()
+	}
+	post := func(body []byte, contentType string) (*http.Response, []byte) {
+		req := httptest.NewRequest("POST", "http://example.com/hash", bytes.NewBuffer(body))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Content-Type", contentType)
+		return fakeRequest(req, makeRouter().ServeHTTP)
+	}
+
+	resp, body := post(gzipped(`{"text":"test gunzip middleware"}`), "application/json")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a gzipped body")
+	var hd hashDocument
+	err := json.Unmarshal(body, &hd)
+	assert.Nil(t, err, "no error unmarshalling response body")
+	assert.Equal(t, hashDocument{Hash: sha256String("test gunzip middleware")}, hd, "hashed the decompressed text")
+
+	resp, _ = post([]byte("this is not gzip"), "application/json")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a body that isn't gzip")
+
+	saved := maxTextBytes
+	maxTextBytes = 1024
+	defer func() { maxTextBytes = saved }()
+
+	bomb := gzipped(`{"text":"` + strings.Repeat("a", 1<<18) + `"}`)
+	assert.True(t, len(bomb) < 1024, "compressed body is under the limit")
+	resp, _ = post(bomb, "application/json")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "returned 413 when the decompressed body is over the limit")
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBuffer(gzipped("truncated gzip")[:20]))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "text/plain")
+	gunzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readSubmittedText(w, r)
+	})).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "returned 400 for a truncated gzip body")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// mtlsAuthenticator accepts a verified TLS client certificate. The subject's
+// common name is looked up in users if that's set, and otherwise is taken to
+// be the user_id itself. Either way the user must exist.
+type mtlsAuthenticator struct {
+	users map[string]string
+}
+
+func (ma mtlsAuthenticator) authenticate(r *http.Request) (string, error) {
+	// VerifiedChains is only filled in for a certificate that chains to one
+	// of our client CAs. A request without one falls through to the rest of
+	// the chain.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil
+	}
+
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	userID := cn
+	if ma.users != nil {
+		userID = ma.users[cn]
+	}
+	if userID == "" {
+		return "", &authError{"unknown_certificate_subject"}
+	}
+	exists, err := userExists(userID)
+	switch {
+	case err != nil:
+		return "", err
+	case !exists:
+		return "", &authError{"unknown_certificate_subject"}
+	}
+	return userID, nil
+}
+
+// parseMTLSUserMap parses a comma-separated list of cn=user_id pairs.
+func parseMTLSUserMap(s string) (map[string]string, error) {
+	users := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		cn, userID, ok := strings.Cut(pair, "=")
+		if !ok || cn == "" || userID == "" {
+			return nil, fmt.Errorf("expected cn=user_id, not %q", pair)
+		}
+		users[cn] = userID
+	}
+	return users, nil
+}
+
+// clientCATLSConfig asks clients for a certificate signed by one of the CAs
+// in caFile. Clients without a certificate can still connect and use the
+// other authenticators.
+func clientCATLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMTLSAuthenticator(t *testing.T) {
+	request := func(cn string) (string, error) {
+		r := httptest.NewRequest("GET", "https://example.com/user/me", nil)
+		if cn != "" {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+		return mtlsAuthenticator{}.authenticate(r)
+	}
+
+	userID, err := request("")
+	assert.Nil(t, err, "no error without a client certificate")
+	assert.Equal(t, "", userID, "no user_id without a client certificate")
+
+	userID, err = request(sha256String("Jane"))
+	assert.Nil(t, err, "no error for a known common name")
+	assert.Equal(t, sha256String("Jane"), userID, "the common name is the user_id")
+
+	_, err = request("nobody")
+	assert.Equal(t, &authError{"unknown_certificate_subject"}, err, "rejected an unknown common name")
+
+	r := httptest.NewRequest("GET", "https://example.com/user/me", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing-service"}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	userID, err = mtlsAuthenticator{users: map[string]string{"billing-service": sha256String("Xiomara")}}.authenticate(r)
+	assert.Nil(t, err, "no error for a mapped common name")
+	assert.Equal(t, sha256String("Xiomara"), userID, "the common name was mapped to a user_id")
+}
+
+func TestParseMTLSUserMap(t *testing.T) {
+	users, err := parseMTLSUserMap("billing=abc, reports=def")
+	assert.Nil(t, err, "no error parsing a valid map")
+	assert.Equal(t, map[string]string{"billing": "abc", "reports": "def"}, users, "got the mapping")
+
+	_, err = parseMTLSUserMap("billing")
+	assert.NotNil(t, err, "error parsing a pair without a user_id")
+}
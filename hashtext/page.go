@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+)
+
+// maxPageSize is the largest limit a client can ask a list endpoint for.
+const maxPageSize = 1000
+
+// defaultPageSize is how many items a list endpoint returns when the client
+// doesn't pass a limit.
+var defaultPageSize = 100
+
+// maxPageBytes caps how large the items in one page of a list can be once
+// they're encoded, so that a page of large items can't make a response much
+// larger than clients expect. A page that would go over it is cut short.
+var maxPageBytes int64 = 1 << 20
+
+// pageParams parses the limit and offset query parameters of a list endpoint.
+// If ok is false it has already sent an error response.
+func pageParams(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	limit, ok = intParam(w, r, "limit", defaultPageSize, 1, maxPageSize)
+	if !ok {
+		return 0, 0, false
+	}
+	offset, ok = intParam(w, r, "offset", 0, 0, math.MaxInt32)
+	return limit, offset, ok
+}
+
+// trimPage cuts items, which should have one more item than the limit if
+// there are any more, down to the page starting at offset. It keeps at most
+// limit items, and stops early rather than go over maxPageBytes, though it
+// always keeps the first item so that paging makes progress. next is the
+// offset of the next page, or nil if this is the last one, and truncated says
+// whether maxPageBytes is what cut the page short.
+func trimPage[T any](items []T, limit, offset int) (page []T, next *int, truncated bool) {
+	n := len(items)
+	if n > limit {
+		n = limit
+	}
+	var size int64
+	for i := 0; i < n; i++ {
+		b, err := json.Marshal(items[i])
+		if err != nil {
+			// sendJSONResponse will fail on it too and log why.
+			break
+		}
+		size += int64(len(b))
+		if size > maxPageBytes && i > 0 {
+			n = i
+			truncated = true
+			break
+		}
+	}
+
+	if n < len(items) {
+		o := offset + n
+		next = &o
+	}
+	return items[:n], next, truncated
+}
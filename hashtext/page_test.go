@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimPage(t *testing.T) {
+	saved := maxPageBytes
+	defer func() { maxPageBytes = saved }()
+	// Each item encodes to 7 bytes, like "aaaaa".
+	items := []string{"aaaaa", "bbbbb", "ccccc", "ddddd"}
+	offset := func(n int) *int { return &n }
+
+	for _, c := range []struct {
+		name      string
+		items     []string
+		limit     int
+		maxBytes  int64
+		page      []string
+		next      *int
+		truncated bool
+	}{
+		{"last page", items[:3], 3, 1000, items[:3], nil, false},
+		{"more pages", items, 3, 1000, items[:3], offset(13), false},
+		{"exactly at the byte cap", items, 3, 21, items[:3], offset(13), false},
+		{"over the byte cap", items, 3, 20, items[:2], offset(12), true},
+		{"byte cap cuts the last page", items[:3], 3, 14, items[:2], offset(12), true},
+		{"first item is always kept", items, 3, 1, items[:1], offset(11), true},
+		{"empty", []string{}, 3, 1, []string{}, nil, false},
+	} {
+		maxPageBytes = c.maxBytes
+		page, next, truncated := trimPage(c.items, c.limit, 10)
+		assert.Equal(t, c.page, page, "%s: got the expected page", c.name)
+		assert.Equal(t, c.next, next, "%s: got the expected next offset", c.name)
+		assert.Equal(t, c.truncated, truncated, "%s: truncated is %v", c.name, c.truncated)
+	}
+}
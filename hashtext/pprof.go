@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// pprofHandler serves the runtime profiles from net/http/pprof, like
+// /debug/pprof/heap. Only admins can reach it, as profiles show what the
+// server is doing for every user, and a CPU profile or trace keeps a request
+// busy for as long as the client asks.
+//
+// Importing net/http/pprof also registers its handlers on
+// http.DefaultServeMux, but we never serve that, so this is the only way in.
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch mux.Vars(r)["profile"] {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		// Index serves the named profiles too, taking the name from the
+		// path.
+		pprof.Index(w, r)
+	}
+}
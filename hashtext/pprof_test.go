@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprofHandler(t *testing.T) {
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+
+	get := func(router http.Handler, path, userID string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		return fakeRequest(req, router.ServeHTTP)
+	}
+
+	resp, _ := get(makeRouter(), "/debug/pprof/", adminID)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 when pprof is off")
+
+	flags.Pprof = true
+	defer func() { flags.Pprof = false }()
+	router := makeRouter()
+
+	resp, body := get(router, "/debug/pprof/", adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the index")
+	assert.Contains(t, string(body), "goroutine", "the index lists the profiles")
+
+	resp, body = get(router, "/debug/pprof/goroutine?debug=1", adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for a named profile")
+	assert.Contains(t, string(body), "goroutine profile:", "got the goroutine profile")
+
+	resp, _ = get(router, "/debug/pprof/cmdline", adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the command line")
+
+	resp, _ = get(router, "/debug/pprof/heap", sha256String("Xiomara"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for a user who isn't an admin")
+
+	req := httptest.NewRequest("GET", "http://example.com/debug/pprof/heap", nil)
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "returned 401 without credentials")
+}
@@ -0,0 +1,57 @@
+package main
+
+import "net/http"
+
+// problemDocument is an RFC 7807 problem details body. We don't define our
+// own problem types, so Type is always about:blank and Title is the standard
+// text for the status.
+type problemDocument struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// problemStatuses are the statuses that are sent as problem details with
+// HASHTEXT_ERROR_FORMAT=problem. Other errors keep their plain text message.
+var problemStatuses = map[int]bool{
+	http.StatusUnauthorized:        true,
+	http.StatusPaymentRequired:     true,
+	http.StatusNotFound:            true,
+	http.StatusInternalServerError: true,
+}
+
+// sendProblem sends an application/problem+json response. The instance is
+// the request's ID, which requestIDMiddleware has already copied into the
+// response headers, so that the client can quote it when asking about the
+// error.
+func sendProblem(w http.ResponseWriter, status int, title, detail string) {
+	writeJSON(w, status, "application/problem+json; charset=UTF-8", problemDocument{
+		Type:     "about:blank",
+		Title:    title,
+		Status:   status,
+		Detail:   detail,
+		Instance: w.Header().Get("X-Request-ID"),
+	})
+}
+
+// sendStatus sends an error response with no message, which is just the
+// status unless it's one of the problemStatuses and we're sending problem
+// details.
+func sendStatus(w http.ResponseWriter, status int) {
+	if flags.problemErrors() && problemStatuses[status] {
+		sendProblem(w, status, http.StatusText(status), "")
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// notFoundHandler answers requests that don't match any route.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if flags.problemErrors() {
+		sendProblem(w, http.StatusNotFound, http.StatusText(http.StatusNotFound), "There is no such route")
+		return
+	}
+	http.NotFound(w, r)
+}
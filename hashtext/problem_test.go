@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemErrors(t *testing.T) {
+	r := makeRouter()
+	r.HandleFunc("/payment", func(w http.ResponseWriter, r *http.Request) {
+		sendErrorMessage(w, "You are out of credit", http.StatusPaymentRequired)
+	})
+	r.HandleFunc("/bad", func(w http.ResponseWriter, r *http.Request) {
+		sendErrorMessage(w, "That's not right", http.StatusBadRequest)
+	})
+	r.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		sendStatus(w, http.StatusInternalServerError)
+	})
+	r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("oh no") })
+	get := func(path string) (*http.Response, []byte) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("X-Request-ID", "test-request")
+		return fakeRequest(req, r.ServeHTTP)
+	}
+
+	resp, body := get("/payment")
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode, "returned 402")
+	assert.Equal(t, "text/plain; charset=UTF-8", resp.Header.Get("Content-Type"), "sent plain text by default")
+	assert.Equal(t, "You are out of credit", string(body), "sent the message by default")
+	assert.Equal(t, "test-request", resp.Header.Get("X-Request-ID"), "sent the request ID back")
+
+	flags.ErrorFormat = errorFormatProblem
+	defer func() { flags.ErrorFormat = errorFormatText }()
+
+	for _, c := range []struct {
+		path string
+		want problemDocument
+	}{
+		{"/payment", problemDocument{Type: "about:blank", Title: "Payment Required", Status: 402, Detail: "You are out of credit", Instance: "test-request"}},
+		{"/broken", problemDocument{Type: "about:blank", Title: "Internal Server Error", Status: 500, Instance: "test-request"}},
+		{"/panic", problemDocument{Type: "about:blank", Title: "Internal Server Error", Status: 500, Instance: "test-request"}},
+		{"/no/such/route", problemDocument{Type: "about:blank", Title: "Not Found", Status: 404, Detail: "There is no such route", Instance: "test-request"}},
+	} {
+		resp, body := get(c.path)
+		assert.Equal(t, c.want.Status, resp.StatusCode, "returned %d for %s", c.want.Status, c.path)
+		assert.Equal(t, "application/problem+json; charset=UTF-8", resp.Header.Get("Content-Type"), "sent problem details for %s", c.path)
+		var pd problemDocument
+		assert.Nil(t, json.Unmarshal(body, &pd), "no error unmarshalling response body")
+		assert.Equal(t, c.want, pd, "got expected problem details for %s", c.path)
+	}
+
+	resp, body = get("/bad")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400")
+	assert.Equal(t, "text/plain; charset=UTF-8", resp.Header.Get("Content-Type"), "a 400 is still plain text")
+	assert.Equal(t, "That's not right", string(body), "a 400 still sends the message")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// pruner periodically deletes texts that were stored and last read more than
+// retention ago. It deletes in batches so that it never holds locks on a large
+// chunk of the table at once.
+type pruner struct {
+	interval  time.Duration
+	retention time.Duration
+	batchSize int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPruner(interval, retention time.Duration) *pruner {
+	return &pruner{
+		interval:  interval,
+		retention: retention,
+		batchSize: 1000,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (p *pruner) start() {
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.prune()
+			}
+		}
+	}()
+}
+
+// shutdown stops the pruner and waits for any batch in progress to finish.
+func (p *pruner) shutdown() {
+	close(p.stop)
+	<-p.done
+}
+
+// prune deletes batches of old texts until there are none left or we're asked
+// to stop. It returns the number of texts deleted.
+func (p *pruner) prune() int64 {
+	var total int64
+	for {
+		// The deleted texts no longer count against the stored bytes of
+		// the users who stored them.
+		var n int64
+		err := db.QueryRow(
+			withTables(`WITH deleted AS (
+			     DELETE FROM {hash_text}
+			      WHERE hash IN (
+			          SELECT hash FROM {hash_text}
+			           WHERE COALESCE(last_accessed_at, created_at) < now() - $1 * interval '1 second'
+			           LIMIT $2
+			      )
+			     RETURNING created_by, octet_length(text) AS bytes
+			 ), freed AS (
+			     UPDATE {user} SET stored_bytes = stored_bytes - f.bytes
+			       FROM (SELECT created_by, SUM(bytes) AS bytes FROM deleted GROUP BY created_by) f
+			      WHERE user_id = f.created_by
+			 )
+			 SELECT COUNT(*) FROM deleted`),
+			p.retention.Seconds(), p.batchSize,
+		).Scan(&n)
+		dbBreaker.record(err)
+		if err != nil {
+			log.Printf("Failed to prune old texts: %v", err)
+			break
+		}
+		total += n
+		if n < int64(p.batchSize) {
+			break
+		}
+
+		select {
+		case <-p.stop:
+			log.Printf("Pruned %d old texts before stopping", total)
+			return total
+		default:
+		}
+	}
+
+	log.Printf("Pruned %d old texts", total)
+	return total
+}
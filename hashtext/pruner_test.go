@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruner(t *testing.T) {
+	old := sha256String("test pruner old text")
+	_, err := db.Exec(
+		`INSERT INTO hash_text (hash, text, created_at) VALUES ($1, $2, now() - interval '10 days')`,
+		old, "test pruner old text",
+	)
+	assert.Nil(t, err, "inserted old text")
+
+	readRecently := sha256String("test pruner old text read recently")
+	_, err = db.Exec(
+		`INSERT INTO hash_text (hash, text, created_at, last_accessed_at) VALUES ($1, $2, now() - interval '10 days', now())`,
+		readRecently, "test pruner old text read recently",
+	)
+	assert.Nil(t, err, "inserted old text that was read recently")
+
+	fresh := sha256String("test pruner fresh text")
+	_, err = db.Exec(`INSERT INTO hash_text (hash, text) VALUES ($1, $2)`, fresh, "test pruner fresh text")
+	assert.Nil(t, err, "inserted fresh text")
+
+	p := newPruner(time.Hour, 24*time.Hour)
+	p.batchSize = 1
+	assert.True(t, p.prune() >= 1, "pruned at least one text")
+
+	for hash, exists := range map[string]bool{old: false, readRecently: true, fresh: true} {
+		var count int
+		err = db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE hash = $1`, hash).Scan(&count)
+		assert.Nil(t, err, "no error looking up hash_text")
+		if exists {
+			assert.Equal(t, 1, count, "text was kept")
+		} else {
+			assert.Equal(t, 0, count, "text was pruned")
+		}
+	}
+
+	p.start()
+	p.shutdown()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter. It holds up to burst tokens and
+// refills at rate tokens per second. Each request takes a token, and requests
+// that find the bucket empty are turned away.
+//
+// A nil *tokenBucket allows everything, which is how the limiter is turned
+// off.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+	}
+}
+
+// take reports whether there was a token to take. When it returns false it
+// also returns how long until the next token is available.
+func (tb *tokenBucket) take() (bool, time.Duration) {
+	if tb == nil {
+		return true, 0
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := tb.now()
+	if !tb.last.IsZero() {
+		tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tb.last = now
+
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// globalLimiter caps the number of requests per second the whole server will
+// handle. It is nil, and therefore allows everything, unless
+// HASHTEXT_GLOBAL_RATE is set.
+var globalLimiter *tokenBucket
+
+// rateLimitExemptPaths are never limited, so that a flood of requests doesn't
+// also make the health checks fail and get the instance restarted, or hide
+// the flood from our metrics.
+var rateLimitExemptPaths = map[string]bool{
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// globalRateLimitMiddleware returns a 503 when the server as a whole is over
+// its rate. There is no per-user limiter yet. If one is added it should run
+// before this one, so that a single abusive user is turned away before they
+// use up everyone else's tokens.
+func globalRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rateLimitExemptPaths[r.URL.Path] {
+			if ok, retry := globalLimiter.take(); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				sendErrorMessage(w, "The server is too busy right now. Please try again later.", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipConcurrencyLimiter caps how many requests each client IP can have in
+// progress at once. Unlike the rate limiter it doesn't care how often a
+// client sends requests, only how many it has open, which is what a client
+// holding connections open with slow requests runs up.
+//
+// A nil *ipConcurrencyLimiter allows everything, which is how it's turned
+// off.
+type ipConcurrencyLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func newIPConcurrencyLimiter(max int) *ipConcurrencyLimiter {
+	return &ipConcurrencyLimiter{max: max, open: map[string]int{}}
+}
+
+// acquire reports whether ip can start another request. If it returns true,
+// release must be called once the request is done.
+func (l *ipConcurrencyLimiter) acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip] >= l.max {
+		return false
+	}
+	l.open[ip]++
+	return true
+}
+
+func (l *ipConcurrencyLimiter) release(ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Deleting idle IPs keeps the map from growing with every client we've
+	// ever seen.
+	if l.open[ip] <= 1 {
+		delete(l.open, ip)
+		return
+	}
+	l.open[ip]--
+}
+
+// ipLimiter is nil, and therefore allows everything, unless
+// HASHTEXT_MAX_CONCURRENT_PER_IP is set.
+var ipLimiter *ipConcurrencyLimiter
+
+// ipConcurrencyMiddleware returns a 429 to a client that already has as many
+// requests in progress as ipLimiter allows. Clients in trustedCIDRs and the
+// paths that are exempt from the rate limit are never limited.
+func ipConcurrencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ipLimiter == nil || rateLimitExemptPaths[r.URL.Path] || ip == nil || trustedIP(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := ip.String()
+		if !ipLimiter.acquire(key) {
+			w.Header().Set("Retry-After", "1")
+			sendErrorMessage(w, "You have too many requests in progress. Please wait for some of them to finish.", http.StatusTooManyRequests)
+			return
+		}
+		defer ipLimiter.release(key)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	tb := newTokenBucket(2, 3)
+	tb.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := tb.take()
+		assert.True(t, ok, "took token %d of the burst", i+1)
+	}
+	ok, retry := tb.take()
+	assert.False(t, ok, "no tokens left after the burst")
+	assert.Equal(t, 500*time.Millisecond, retry, "next token is half a second away")
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = tb.take()
+	assert.True(t, ok, "a token was added after half a second")
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = tb.take()
+		assert.True(t, ok, "bucket refilled up to the burst")
+	}
+	ok, _ = tb.take()
+	assert.False(t, ok, "bucket never holds more than the burst")
+
+	var off *tokenBucket
+	ok, _ = off.take()
+	assert.True(t, ok, "a nil bucket allows everything")
+}
+
+func TestGlobalRateLimitMiddleware(t *testing.T) {
+	globalLimiter = newTokenBucket(0.001, 1)
+	defer func() { globalLimiter = nil }()
+
+	r := makeRouter()
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+	req := httptest.NewRequest("GET", "http://example.com/ok", nil)
+	resp, _ := fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "first request is allowed")
+
+	resp, _ = fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 over the global rate")
+	assert.NotEqual(t, "", resp.Header.Get("Retry-After"), "got a Retry-After header")
+
+	req = httptest.NewRequest("GET", "http://example.com/livez", nil)
+	resp, _ = fakeRequest(req, r.ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "health checks are exempt")
+}
+
+func TestIPConcurrencyLimiter(t *testing.T) {
+	l := newIPConcurrencyLimiter(2)
+	assert.True(t, l.acquire("192.0.2.1"), "first request is allowed")
+	assert.True(t, l.acquire("192.0.2.1"), "second request is allowed")
+	assert.False(t, l.acquire("192.0.2.1"), "third request is over the limit")
+	assert.True(t, l.acquire("192.0.2.2"), "other IPs have their own limit")
+
+	l.release("192.0.2.1")
+	assert.True(t, l.acquire("192.0.2.1"), "finishing a request makes room for another")
+
+	l.release("192.0.2.1")
+	l.release("192.0.2.1")
+	l.release("192.0.2.2")
+	assert.Empty(t, l.open, "idle IPs are forgotten")
+
+	var off *ipConcurrencyLimiter
+	assert.True(t, off.acquire("192.0.2.1"), "a nil limiter allows everything")
+	off.release("192.0.2.1")
+}
+
+func TestIPConcurrencyMiddleware(t *testing.T) {
+	ipLimiter = newIPConcurrencyLimiter(1)
+	defer func() { ipLimiter = nil }()
+	trustedCIDRs, _ = parseCIDRs("10.0.0.0/8")
+	defer func() { trustedCIDRs = nil }()
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	r := makeRouter()
+	r.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-finish
+	})
+	r.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+
+	request := func(path, remoteAddr string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = remoteAddr
+		resp, _ := fakeRequest(req, r.ServeHTTP)
+		return resp
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); request("/slow", "192.0.2.1:1234") }()
+	go func() { defer wg.Done(); request("/slow", "10.1.2.3:1234") }()
+	<-started
+	<-started
+
+	resp := request("/ok", "192.0.2.1:5678")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "returned 429 over the limit")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"), "got a Retry-After header")
+
+	resp = request("/ok", "192.0.2.2:1234")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "other IPs aren't limited")
+	resp = request("/ok", "10.1.2.3:5678")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "trusted IPs aren't limited")
+	resp = request("/livez", "192.0.2.1:5678")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "health checks are exempt")
+
+	close(finish)
+	wg.Wait()
+	resp = request("/ok", "192.0.2.1:5678")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "allowed again once the slow request finished")
+}
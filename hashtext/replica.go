@@ -0,0 +1,21 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// withReadFallback runs query against readDB. If that fails and
+// flags.ReplicaFallback is set, it runs query again against the primary, so
+// that reads keep working while the replica is down. sql.ErrNoRows is an
+// answer rather than a failure, so it's never retried.
+func withReadFallback(query func(q *sql.DB) error) error {
+	err := query(readDB)
+	if err == nil || err == sql.ErrNoRows || readDB == db || !flags.ReplicaFallback {
+		return err
+	}
+
+	log.Printf("Read from the replica failed, retrying on the primary: %v", err)
+	replicaFallbacks.add("", 1)
+	return query(db)
+}
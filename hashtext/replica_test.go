@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithReadFallback(t *testing.T) {
+	replica, err := sql.Open("postgres", "host=127.0.0.1 dbname=hashtext_replica")
+	assert.Nil(t, err, "no error opening a pool")
+	defer replica.Close()
+
+	savedReadDB := readDB
+	readDB = replica
+	defer func() { readDB = savedReadDB }()
+
+	replicaDown := errors.New("replica is down")
+	var queried []*sql.DB
+	query := func(q *sql.DB) error {
+		queried = append(queried, q)
+		if q == replica {
+			return replicaDown
+		}
+		return nil
+	}
+
+	err = withReadFallback(query)
+	assert.Equal(t, replicaDown, err, "got the replica's error without the fallback")
+	assert.Equal(t, []*sql.DB{replica}, queried, "only queried the replica without the fallback")
+
+	flags.ReplicaFallback = true
+	defer func() { flags.ReplicaFallback = false }()
+
+	before := replicaFallbacks.get("")
+	queried = nil
+	err = withReadFallback(query)
+	assert.Nil(t, err, "no error after falling back to the primary")
+	assert.Equal(t, []*sql.DB{replica, db}, queried, "queried the primary after the replica failed")
+	assert.Equal(t, before+1, replicaFallbacks.get(""), "counted the fallback")
+
+	queried = nil
+	err = withReadFallback(func(q *sql.DB) error {
+		queried = append(queried, q)
+		return sql.ErrNoRows
+	})
+	assert.Equal(t, sql.ErrNoRows, err, "got sql.ErrNoRows")
+	assert.Equal(t, []*sql.DB{replica}, queried, "didn't retry a query that found no rows")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An authMode says what a route needs from the request's credentials.
+type authMode string
+
+const (
+	// authRequired rejects requests without a valid credential. It's the
+	// default for every route.
+	authRequired authMode = "required"
+	// authOptional identifies the user when the request has a credential,
+	// but lets anonymous requests through. A bad credential is still
+	// rejected.
+	authOptional authMode = "optional"
+	// authNone skips authentication entirely.
+	authNone authMode = "none"
+)
+
+// authRoutes are the names of the routes whose auth mode can be configured.
+// The value says whether the route's handler works without a user, which is
+// required for any mode other than authRequired.
+var authRoutes = map[string]bool{
+	"user.get":       false,
+	"user.patch":     false,
+	"user.summary":   false,
+	"user.hashes":    false,
+	"api-key.rotate": false,
+	"text.create":    false,
+	"text.cost":      false,
+	"text.reserve":   false,
+	"text.commit":    false,
+	"text.release":   false,
+	"text.get":       true,
+	"text.verify":    true,
+	"text.share":     false,
+}
+
+// routeAuth maps route names to their auth mode. Routes that aren't listed use
+// authRequired.
+var routeAuth = map[string]authMode{}
+
+// parseRouteAuth parses a comma-separated list of name=mode pairs, like
+// "text.get=none".
+func parseRouteAuth(s string) (map[string]authMode, error) {
+	modes := map[string]authMode{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, mode, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected route=mode, not %q", pair)
+		}
+		anonymous, known := authRoutes[name]
+		if !known {
+			return nil, fmt.Errorf("unknown route %q", name)
+		}
+		switch m := authMode(mode); m {
+		case authRequired:
+		case authOptional, authNone:
+			if !anonymous {
+				return nil, fmt.Errorf("route %q needs a user, so its auth must be %q", name, authRequired)
+			}
+		default:
+			return nil, fmt.Errorf("unknown auth mode %q for route %q", mode, name)
+		}
+		modes[name] = authMode(mode)
+	}
+	return modes, nil
+}
+
+// routeAuthMode returns the configured auth mode for the named route.
+func routeAuthMode(name string) authMode {
+	if m, ok := routeAuth[name]; ok {
+		return m
+	}
+	return authRequired
+}
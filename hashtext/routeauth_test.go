@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRouteAuth(t *testing.T) {
+	modes, err := parseRouteAuth("text.get=none, user.get=required")
+	assert.Nil(t, err, "no error parsing route auth")
+	assert.Equal(t, map[string]authMode{"text.get": authNone, "user.get": authRequired}, modes, "got the modes")
+
+	for _, s := range []string{
+		"text.get",
+		"text.nope=none",
+		"text.get=sometimes",
+		"text.create=optional",
+		"user.get=none",
+	} {
+		_, err = parseRouteAuth(s)
+		assert.NotNil(t, err, "error parsing %q", s)
+	}
+}
+
+func TestPublicRoute(t *testing.T) {
+	text := "test public route"
+	hash := hashText(text)
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2)", hash, text)
+	assert.Nil(t, err, "inserted text and hash")
+
+	get := func(path string) *http.Response {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		resp, _ := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+		return resp
+	}
+	textPath := fmt.Sprintf("/text/%s", hash)
+
+	assert.Equal(t, http.StatusUnauthorized, get(textPath).StatusCode, "returned 401 for an anonymous read by default")
+
+	defer func() { routeAuth = map[string]authMode{} }()
+	for _, mode := range []authMode{authOptional, authNone} {
+		routeAuth = map[string]authMode{"text.get": mode}
+		assert.Equal(t, http.StatusOK, get(textPath).StatusCode, "returned 200 for an anonymous read with %s auth", mode)
+		assert.Equal(t, http.StatusUnauthorized, get("/user/me").StatusCode, "other routes still require auth with text.get=%s", mode)
+	}
+}
@@ -1,11 +1,166 @@
 package main
 
-import "github.com/gorilla/mux"
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
 
 func makeRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/user/me", wrapHandler(userHandler)).Methods("GET")
-	r.HandleFunc("/text", wrapHandler(textHandler)).Methods("POST")
-	r.HandleFunc("/text/{hash}", wrapHandler(textHashHandler)).Methods("GET")
+	r.Use(securityHeadersMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(noticeMiddleware)
+	r.Use(recoverMiddleware)
+	r.Use(ipConcurrencyMiddleware)
+	r.Use(globalRateLimitMiddleware)
+	r.Use(gunzipMiddleware)
+	// Middleware only runs for matched routes, so the 404 and 405 responses
+	// need the security headers and request ID added separately.
+	r.NotFoundHandler = securityHeadersMiddleware(requestIDMiddleware(trailingSlashRedirect(r, http.HandlerFunc(notFoundHandler))))
+	r.MethodNotAllowedHandler = securityHeadersMiddleware(requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})))
+	// Every route has a name, so that it can be turned off with
+	// HASHTEXT_DISABLED_ROUTES. A disabled route isn't registered at all.
+	handle := func(name, method, path string, handler http.HandlerFunc) {
+		if routeDisabled(name) {
+			return
+		}
+		r.HandleFunc(path, handler).Methods(method).Name(name)
+	}
+	if !flags.DisableIndex {
+		handle("index", "GET", "/", indexHandler)
+	}
+	handle("user.get", "GET", "/user/me", wrapRoute("user.get", userHandler))
+	handle("user.patch", "PATCH", "/user/me", wrapRoute("user.patch", userPatchHandler))
+	handle("user.summary", "GET", "/user/me/summary", wrapRoute("user.summary", userSummaryHandler))
+	handle("user.hashes", "GET", "/user/me/hashes", wrapRoute("user.hashes", userHashesHandler))
+	handle("api-key.rotate", "POST", "/user/me/api-key/rotate", wrapRoute("api-key.rotate", apiKeyRotateHandler))
+	handle("text.create", "POST", "/text", wrapRoute("text.create", textHandler))
+	handle("admin.texts", "GET", "/text", wrapAdminHandler(adminTextsHandler))
+	handle("text.cost", "POST", "/text/cost", wrapRoute("text.cost", textCostHandler))
+	handle("text.reserve", "POST", "/text/reserve", wrapRoute("text.reserve", reserveHandler))
+	handle("text.commit", "POST", "/text/commit", wrapRoute("text.commit", commitHandler))
+	handle("text.release", "POST", "/text/release", wrapRoute("text.release", releaseHandler))
+	handle("text.get", "GET", "/text/{hash:"+textDigest.Pattern+"}", wrapRoute("text.get", textHashHandler))
+	handle("text.verify", "POST", "/text/{hash:"+textDigest.Pattern+"}/verify", wrapRoute("text.verify", textVerifyHandler))
+	if len(shareSecret) > 0 {
+		handle("text.share", "POST", "/text/{hash:"+textDigest.Pattern+"}/share", wrapRoute("text.share", textShareHandler))
+		handle("shared.get", "GET", "/shared/{hash:"+textDigest.Pattern+"}", wrapHandlerWithMode(authNone, sharedTextHandler))
+	}
+	handle("hash", "POST", "/hash", hashHandler)
+	handle("hash.stream", "POST", "/hash/stream", hashStreamHandler)
+	handle("limits", "GET", "/limits", limitsHandler)
+	handle("livez", "GET", "/livez", livezHandler)
+	handle("readyz", "GET", "/readyz", readyzHandler)
+	if flags.Metrics {
+		handle("metrics", "GET", "/metrics", metricsHandler)
+	}
+	handle("admin.stats", "GET", "/admin/stats", wrapAdminHandler(adminStatsHandler))
+	handle("admin.flags", "GET", "/admin/flags", wrapAdminHandler(adminFlagsHandler))
+	handle("admin.text-delete", "POST", "/admin/text/delete", wrapAdminHandler(adminTextDeleteHandler))
+	handle("admin.text-meta", "GET", "/admin/text/{hash:"+textDigest.Pattern+"}/meta", wrapAdminHandler(adminTextMetaHandler))
+	handle("admin.entitlements", "PUT", "/admin/user/{user_id:[0-9a-f]{64}}/entitlements", wrapAdminHandler(adminEntitlementsHandler))
+	if selftestUserID != "" {
+		handle("admin.selftest", "POST", "/admin/selftest", wrapAdminHandler(adminSelftestHandler))
+	}
+	handle("admin.audit", "GET", "/admin/audit", wrapAdminHandler(adminAuditHandler))
+	if flags.Pprof {
+		// Unlike our other routes, the index ends in a slash, as that's
+		// where the pprof tools expect it.
+		handle("debug.pprof", "GET", "/debug/pprof/", wrapAdminHandler(pprofHandler))
+		handle("debug.pprof-profile", "GET", "/debug/pprof/{profile}", wrapAdminHandler(pprofHandler))
+		handle("debug.pprof-symbol", "POST", "/debug/pprof/{profile:symbol}", wrapAdminHandler(pprofHandler))
+	}
 	return r
 }
+
+// disabledRoutes are the names of the routes makeRouter leaves out, from
+// HASHTEXT_DISABLED_ROUTES. A name ending in .* disables every route whose
+// name starts with the part before it, so admin.* disables all the admin
+// routes.
+var disabledRoutes = map[string]bool{}
+
+func routeDisabled(name string) bool {
+	if disabledRoutes[name] {
+		return true
+	}
+	for i, c := range name {
+		if c == '.' && disabledRoutes[name[:i]+".*"] {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDisabledRoutes parses a comma-separated list of route names. Each name
+// must be one of known, or a group like admin.* that matches one of them.
+func parseDisabledRoutes(s string, known []string) (map[string]bool, error) {
+	disabled := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, k := range known {
+			if k == name || (strings.HasSuffix(name, ".*") && strings.HasPrefix(k, strings.TrimSuffix(name, "*"))) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("there is no route named %q", name)
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// routeNames returns the names of the routes registered on router.
+func routeNames(router *mux.Router) []string {
+	var names []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if name := route.GetName(); name != "" {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
+
+// trailingSlashRedirect redirects a request with a trailing slash to the same
+// path without it, if that's a route we have. Our routes never end in a
+// slash. GET and HEAD get a 301. Other methods get a 308, because clients
+// are allowed to turn a redirected POST into a GET on a 301, and we don't
+// want the body dropped. Anything else is passed on to notFound.
+func trailingSlashRedirect(router *mux.Router, notFound http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if path == "/" || !strings.HasSuffix(path, "/") {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+
+		canonical := r.Clone(r.Context())
+		canonical.URL.Path = strings.TrimRight(path, "/")
+		canonical.URL.RawPath = ""
+		if canonical.URL.Path == "" {
+			canonical.URL.Path = "/"
+		}
+		var match mux.RouteMatch
+		if !router.Match(canonical, &match) || match.MatchErr != nil {
+			notFound.ServeHTTP(w, r)
+			return
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, canonical.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeRouter(t *testing.T) {
+	// Building the router must not touch the database.
+	saved := db
+	db = nil
+	defer func() { db = saved }()
+
+	var routes []string
+	err := makeRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, m := range methods {
+			routes = append(routes, m+" "+path)
+		}
+		return nil
+	})
+	assert.Nil(t, err, "no error walking the router")
+
+	assert.ElementsMatch(t, []string{
+		"GET /",
+		"GET /user/me",
+		"PATCH /user/me",
+		"GET /user/me/summary",
+		"GET /user/me/hashes",
+		"POST /user/me/api-key/rotate",
+		"POST /text",
+		"GET /text",
+		"POST /text/cost",
+		"POST /text/reserve",
+		"POST /text/commit",
+		"POST /text/release",
+		"GET /text/{hash:[0-9a-f]{64}}",
+		"POST /text/{hash:[0-9a-f]{64}}/verify",
+		"POST /hash",
+		"POST /hash/stream",
+		"GET /limits",
+		"GET /livez",
+		"GET /readyz",
+		"GET /admin/stats",
+		"GET /admin/flags",
+		"POST /admin/text/delete",
+		"GET /admin/text/{hash:[0-9a-f]{64}}/meta",
+		"PUT /admin/user/{user_id:[0-9a-f]{64}}/entitlements",
+		"GET /admin/audit",
+	}, routes, "router has the expected routes")
+}
+
+func TestTrailingSlashRedirect(t *testing.T) {
+	router := makeRouter()
+	hash := sha256String("test trailing slash redirect")
+	vars := regexp.MustCompile(`\{\w+:[^}]*\}\}?`)
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		path := vars.ReplaceAllString(template, hash)
+		for _, m := range methods {
+			var match mux.RouteMatch
+			req := httptest.NewRequest(m, "http://example.com"+path, nil)
+			assert.True(t, router.Match(req, &match) && match.MatchErr == nil, "%s %s matches without a trailing slash", m, path)
+			if path == "/" {
+				continue
+			}
+
+			want := http.StatusPermanentRedirect
+			if m == "GET" {
+				want = http.StatusMovedPermanently
+			}
+			req = httptest.NewRequest(m, "http://example.com"+path+"/?x=1", nil)
+			resp, _ := fakeRequest(req, router.ServeHTTP)
+			assert.Equal(t, want, resp.StatusCode, "%s %s/ redirects", m, path)
+			assert.Equal(t, path+"?x=1", resp.Header.Get("Location"), "%s %s/ redirects to the path without the slash", m, path)
+		}
+		return nil
+	})
+	assert.Nil(t, err, "no error walking the router")
+
+	req := httptest.NewRequest("GET", "http://example.com/nope/", nil)
+	resp, _ := fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for an unknown path with a trailing slash")
+
+	req = httptest.NewRequest("DELETE", "http://example.com/user/me/", nil)
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 when the path without the slash doesn't take the method")
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	known := routeNames(makeRouter())
+	assert.Contains(t, known, "text.create", "the routes are named")
+
+	disabled, err := parseDisabledRoutes("text.create, admin.*", known)
+	assert.Nil(t, err, "no error parsing disabled routes")
+	assert.Equal(t, map[string]bool{"text.create": true, "admin.*": true}, disabled, "got the disabled routes")
+	for _, s := range []string{"text.nope", "nope.*", "text"} {
+		_, err := parseDisabledRoutes(s, known)
+		assert.NotNil(t, err, "error disabling %q", s)
+	}
+
+	disabledRoutes = disabled
+	defer func() { disabledRoutes = map[string]bool{} }()
+	router := makeRouter()
+
+	for _, name := range routeNames(router) {
+		assert.NotEqual(t, "text.create", name, "text.create isn't registered")
+		assert.False(t, strings.HasPrefix(name, "admin."), "%s isn't registered", name)
+	}
+	assert.Nil(t, router.Get("text.create"), "text.create can't be found by name")
+	assert.NotNil(t, router.Get("text.get"), "text.get is still registered")
+
+	adminUserIDs = map[string]bool{sha256String("Jane"): true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+	for _, path := range []string{"POST /text", "GET /text", "GET /admin/stats"} {
+		method, url, _ := strings.Cut(path, " ")
+		req := httptest.NewRequest(method, "http://example.com"+url, nil)
+		req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+		resp, _ := fakeRequest(req, router.ServeHTTP)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 for %s", path)
+	}
+}
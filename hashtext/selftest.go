@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// selftestUserID is the user that POST /admin/selftest submits its text as.
+// It must already exist and have at least textPrice in credit, which the
+// self-test debits and then gives back. The route isn't registered unless
+// this is set.
+var selftestUserID string
+
+type selftestStep struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type selftestDocument struct {
+	OK    bool           `json:"ok"`
+	Steps []selftestStep `json:"steps"`
+}
+
+// errSelftestRollback makes withTx roll back the self-test's transaction.
+var errSelftestRollback = errors.New("rolling back the self-test")
+
+// adminSelftestHandler stores a random text as selftestUserID, charges for
+// it, and reads it back, using the same code as POST /text, all in one
+// transaction that's always rolled back. That leaves nothing behind, not even
+// in the metrics, so it's safe to run as often as you like. The read is made
+// in the transaction, so it can't check the read replica. It returns a 503 if
+// any step fails.
+func adminSelftestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), selftestContextKey, true)
+	sd := selftestDocument{Steps: []selftestStep{}}
+	step := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		s := selftestStep{Name: name, OK: err == nil, DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		sd.Steps = append(sd.Steps, s)
+		return err == nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		step("generate", func() error { return err })
+		sendJSONResponseWithStatus(w, http.StatusServiceUnavailable, sd)
+		return
+	}
+	text := "hashtext self-test " + token
+	hash := hashText(text)
+
+	err = withTx(ctx, func(tx *sql.Tx) error {
+		if step("store", func() error { return selftestStore(ctx, tx, text, hash) }) &&
+			step("debit", func() error { return selftestDebit(ctx, tx) }) {
+			step("read", func() error { return selftestRead(ctx, tx, text, hash) })
+		}
+		return errSelftestRollback
+	})
+	if err != errSelftestRollback {
+		// withTx only returns anything else when it couldn't begin.
+		step("begin", func() error { return err })
+	}
+
+	sd.OK = true
+	for _, s := range sd.Steps {
+		sd.OK = sd.OK && s.OK
+	}
+	status := http.StatusOK
+	if !sd.OK {
+		status = http.StatusServiceUnavailable
+	}
+	sendJSONResponseWithStatus(w, status, sd)
+}
+
+// inSelftest reports whether ctx belongs to a self-test, whose texts and
+// debits are always rolled back and so mustn't be counted in the metrics.
+func inSelftest(ctx context.Context) bool {
+	selftest, _ := ctx.Value(selftestContextKey).(bool)
+	return selftest
+}
+
+func selftestStore(ctx context.Context, tx *sql.Tx, text, hash string) error {
+	novel, err := storeText(ctx, tx, text, hash, selftestUserID, 0)
+	if err == nil && !novel {
+		return fmt.Errorf("a new random text was already stored")
+	}
+	return err
+}
+
+func selftestDebit(ctx context.Context, tx *sql.Tx) error {
+	d, err := debitCredit(ctx, tx, selftestUserID, true)
+	if err == nil && flags.creditEnabled() && d.cost != textPrice {
+		return fmt.Errorf("charged %s rather than %s, so the self-test user may be out of credit", d.cost, textPrice)
+	}
+	return err
+}
+
+func selftestRead(ctx context.Context, tx *sql.Tx, text, hash string) error {
+	var stored string
+	err := tx.QueryRowContext(ctx, withTables(`SELECT text FROM {hash_text} WHERE hash = $1`), hash).Scan(&stored)
+	dbBreaker.recordContext(ctx, err)
+	switch {
+	case err != nil:
+		return err
+	case stored != text:
+		return fmt.Errorf("read back a different text than was stored")
+	case hashText(stored) != hash:
+		return fmt.Errorf("the text read back doesn't hash to %s", hash)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminSelftestHandler(t *testing.T) {
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+	userID := sha256String("Selma")
+	execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, 'Selma', 1)`, userID)
+	selftestUserID = userID
+	defer func() { selftestUserID = "" }()
+	router := makeRouter()
+
+	selftest := func() (*http.Response, selftestDocument) {
+		req := httptest.NewRequest("POST", "http://example.com/admin/selftest", nil)
+		req.Header.Set("X-HashText-User-ID", adminID)
+		resp, body := fakeRequest(req, router.ServeHTTP)
+		var sd selftestDocument
+		assert.Nil(t, json.Unmarshal(body, &sd), "no error unmarshalling response body")
+		return resp, sd
+	}
+	names := func(sd selftestDocument) []string {
+		var ns []string
+		for _, s := range sd.Steps {
+			ns = append(ns, s.Name)
+		}
+		return ns
+	}
+
+	stored, debited := textsStored.get(""), creditsDebited.get(metricsUser(userID))
+	for i := 0; i < 2; i++ {
+		resp, sd := selftest()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for run %d", i)
+		assert.True(t, sd.OK, "every step passed on run %d", i)
+		assert.Equal(t, []string{"store", "debit", "read"}, names(sd), "ran every step on run %d", i)
+	}
+	assert.Equal(t, int64(1), creditFor(t, userID), "the self-test user's credit was given back")
+	assert.Equal(t, stored, textsStored.get(""), "the self-test didn't count its texts")
+	assert.Equal(t, debited, creditsDebited.get(metricsUser(userID)), "the self-test didn't count its debits")
+	var left int
+	err := db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE created_by = $1`, userID).Scan(&left)
+	assert.Nil(t, err, "no error counting texts")
+	assert.Equal(t, 0, left, "the self-test left no texts behind")
+
+	execWithCheck(db, `UPDATE "user" SET credit = 0 WHERE user_id = $1`, userID)
+	resp, sd := selftest()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "returned 503 when a step failed")
+	assert.False(t, sd.OK, "the self-test failed")
+	if assert.Equal(t, []string{"store", "debit"}, names(sd), "stopped after the failed step") {
+		assert.False(t, sd.Steps[1].OK, "the debit failed without credit")
+		assert.NotEmpty(t, sd.Steps[1].Error, "said why the debit failed")
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/admin/selftest", nil)
+	req.Header.Set("X-HashText-User-ID", userID)
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for a user who isn't an admin")
+}
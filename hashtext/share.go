@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// shareSecret signs the links made by POST /text/{hash}/share. Sharing is
+// turned off, and its routes aren't registered, unless it's set. Every
+// instance must use the same secret, and changing it breaks every link
+// that's been handed out.
+var shareSecret []byte
+
+// shareTTL is how long a shared link works for.
+var shareTTL = 24 * time.Hour
+
+// shareSignature is the HMAC of the hash and the expiry time, so that neither
+// can be changed without the link no longer working.
+func shareSignature(hash string, expires int64) string {
+	mac := hmac.New(sha256.New, shareSecret)
+	mac.Write([]byte(hash + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sharedPath is the path of the link to a text that works until expires.
+func sharedPath(hash string, expires int64) string {
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(expires, 10))
+	q.Set("sig", shareSignature(hash, expires))
+	return "/shared/" + hash + "?" + q.Encode()
+}
+
+// validShare checks the signature and expiry of a shared link.
+func validShare(hash, exp, sig string, now time.Time) bool {
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(shareSignature(hash, expires)))
+}
+
+type shareDocument struct {
+	URL       string   `json:"url"`
+	ExpiresAt jsonTime `json:"expires_at"`
+}
+
+// textShareHandler makes a link to a stored text that anyone can read for
+// shareTTL, without credentials. The link is a path, like the Location
+// header textHandler sends, as we don't know what host the client reached us
+// through.
+func textShareHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	var stored bool
+	err := withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(withTables(`SELECT EXISTS (SELECT 1 FROM {hash_text} WHERE hash = $1)`), hash).Scan(&stored)
+	})
+	dbBreaker.record(err)
+	if err != nil {
+		log.Printf("Query to look up text by hash failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+	if !stored {
+		sendTextNotFound(w, hash)
+		return
+	}
+
+	expires := time.Now().Add(shareTTL).Truncate(time.Second)
+	sendJSONResponse(w, shareDocument{
+		URL:       sharedPath(hash, expires.Unix()),
+		ExpiresAt: jsonTime{expires},
+	})
+}
+
+// sharedTextHandler serves a text to anyone with a valid shared link. It's
+// only ever a read, so there's nothing to charge for.
+func sharedTextHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	q := r.URL.Query()
+	if !validShare(hash, q.Get("exp"), q.Get("sig"), time.Now()) {
+		sendErrorMessage(w, "This link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	text, ok := readText(w, hash)
+	if !ok {
+		return
+	}
+	if acceptsPlainText(r) {
+		sendTextResponse(w, text)
+		return
+	}
+	sendJSONResponse(w, newTextDocument(text))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidShare(t *testing.T) {
+	shareSecret = []byte("test secret")
+	defer func() { shareSecret = nil }()
+	hash := hashText("test valid share")
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	sig := shareSignature(hash, exp)
+
+	assert.True(t, validShare(hash, strconv.FormatInt(exp, 10), sig, now), "a fresh link is valid")
+	assert.False(t, validShare(hash, strconv.FormatInt(exp, 10), sig, now.Add(2*time.Hour)), "an expired link isn't valid")
+	assert.False(t, validShare(hash, strconv.FormatInt(exp+3600, 10), sig, now), "a link with a later expiry isn't valid")
+	assert.False(t, validShare(hashText("another text"), strconv.FormatInt(exp, 10), sig, now), "a link for another hash isn't valid")
+	assert.False(t, validShare(hash, strconv.FormatInt(exp, 10), "", now), "a link without a signature isn't valid")
+	assert.False(t, validShare(hash, "soon", sig, now), "a link with a bad expiry isn't valid")
+
+	shareSecret = []byte("another secret")
+	assert.False(t, validShare(hash, strconv.FormatInt(exp, 10), sig, now), "a link signed with another secret isn't valid")
+}
+
+func TestShareRoutes(t *testing.T) {
+	assert.NotContains(t, routeNames(makeRouter()), "text.share", "sharing is off without a secret")
+
+	shareSecret = []byte("test secret")
+	defer func() { shareSecret = nil }()
+	router := makeRouter()
+
+	text := "test share routes"
+	hash := hashText(text)
+	_, err := db.Exec("INSERT INTO hash_text (hash, text) VALUES ($1, $2)", hash, text)
+	assert.Nil(t, err, "inserted text and hash")
+
+	req := httptest.NewRequest("POST", "http://example.com/text/"+hash+"/share", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, body := fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 sharing a stored text")
+	var sd shareDocument
+	assert.Nil(t, json.Unmarshal(body, &sd), "no error unmarshalling response body")
+	assert.WithinDuration(t, time.Now().Add(shareTTL), sd.ExpiresAt.Time, time.Minute, "link expires after shareTTL")
+
+	req = httptest.NewRequest("GET", "http://example.com"+sd.URL, nil)
+	resp, body = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the shared link without credentials")
+	var td textDocument
+	assert.Nil(t, json.Unmarshal(body, &td), "no error unmarshalling response body")
+	assert.Equal(t, newTextDocument(text), td, "got the shared text")
+
+	u, _ := url.Parse(sd.URL)
+	q := u.Query()
+	q.Set("exp", strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10))
+	req = httptest.NewRequest("GET", "http://example.com"+u.Path+"?"+q.Encode(), nil)
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for a link with a changed expiry")
+
+	req = httptest.NewRequest("POST", "http://example.com/text/"+hashText("test share routes missing")+"/share", nil)
+	req.Header.Set("X-HashText-User-ID", sha256String("Jane"))
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "returned 404 sharing a text that isn't stored")
+
+	req = httptest.NewRequest("POST", "http://example.com/text/"+hash+"/share", nil)
+	resp, _ = fakeRequest(req, router.ServeHTTP)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "returned 401 sharing without credentials")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"log"
+	"strings"
+	"time"
+)
+
+// slowQueryThreshold is how long a query can take before we log it. Zero
+// turns the logging off.
+var slowQueryThreshold = time.Second
+
+// pqConn is everything a lib/pq connection implements that database/sql
+// looks for, so that a timedConn can embed one without hiding any of it.
+type pqConn interface {
+	driver.Conn
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// timedConnector wraps every connection it makes in a timedConn. We time
+// queries at the driver rather than in the handlers so that every query, in
+// or out of a transaction, is covered without each caller remembering to.
+type timedConnector struct {
+	driver.Connector
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, ok := conn.(pqConn)
+	if !ok {
+		return conn, nil
+	}
+	return timedConn{pc}, nil
+}
+
+type timedConn struct {
+	pqConn
+}
+
+// QueryContext is only timed until the first rows come back, not until the
+// caller has read them all.
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer timeQuery(query, time.Now())
+	return c.pqConn.QueryContext(ctx, query, args)
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer timeQuery(query, time.Now())
+	return c.pqConn.ExecContext(ctx, query, args)
+}
+
+// timeQuery records how long the query took in the query_duration_seconds
+// histogram, and logs it if it was slow.
+func timeQuery(query string, start time.Time) {
+	elapsed := time.Since(start)
+	queryDuration.observe(elapsed.Seconds())
+	if isSlowQuery(elapsed) {
+		log.Printf("WARNING: Slow query took %s: %s", elapsed, queryOperation(query))
+	}
+}
+
+func isSlowQuery(elapsed time.Duration) bool {
+	return slowQueryThreshold > 0 && elapsed > slowQueryThreshold
+}
+
+// queryOperation names a query for the log by squashing its whitespace onto
+// one line and cutting it short. Our queries only take their values as
+// parameters, so this never logs a text or credential.
+func queryOperation(query string) string {
+	op := strings.Join(strings.Fields(query), " ")
+	if len(op) > 100 {
+		op = op[:100] + "..."
+	}
+	return op
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsSlowQuery(t *testing.T) {
+	saved := slowQueryThreshold
+	defer func() { slowQueryThreshold = saved }()
+
+	slowQueryThreshold = 100 * time.Millisecond
+	assert.False(t, isSlowQuery(50*time.Millisecond), "a fast query isn't slow")
+	assert.True(t, isSlowQuery(150*time.Millisecond), "a query over the threshold is slow")
+
+	slowQueryThreshold = 0
+	assert.False(t, isSlowQuery(time.Hour), "nothing is slow when the threshold is zero")
+}
+
+func TestQueryOperation(t *testing.T) {
+	assert.Equal(t,
+		`SELECT text FROM hash_text WHERE hash = $1`,
+		queryOperation("SELECT text\n\t  FROM hash_text\n\t WHERE hash = $1"),
+		"squashed the whitespace in a query",
+	)
+
+	long := queryOperation("SELECT " + strings.Repeat("a, ", 100) + "b FROM t")
+	assert.Equal(t, 103, len(long), "cut a long query short")
+	assert.True(t, strings.HasSuffix(long, "..."), "marked a long query as cut short")
+}
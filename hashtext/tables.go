@@ -0,0 +1,23 @@
+package main
+
+import "github.com/ActiveState/golang-gorilla-webapp/hashstore"
+
+// searchPath is the schema our tables are in, for databases that keep each
+// tenant in a schema of its own. Postgres looks in public by default, so we
+// only ask for a search_path when it's something else.
+var searchPath = "public"
+
+var tables, _ = hashstore.NewTableNames("")
+
+var tableReplacer = tables.Replacer()
+
+func setTableNames(t hashstore.TableNames) {
+	tables = t
+	tableReplacer = t.Replacer()
+}
+
+// withTables replaces the table placeholders in query with the configured
+// table names.
+func withTables(query string) string {
+	return tableReplacer.Replace(query)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTables(t *testing.T) {
+	assert.Equal(t,
+		`SELECT credit FROM "user" u JOIN "hash_text" h ON h.created_by = u.user_id`,
+		withTables(`SELECT credit FROM {user} u JOIN {hash_text} h ON h.created_by = u.user_id`),
+		"used the default table names",
+	)
+
+	saved := tables
+	defer setTableNames(saved)
+
+	prefixed, err := hashstore.NewTableNames("ht_")
+	assert.Nil(t, err, "no error with a valid prefix")
+	setTableNames(prefixed)
+	assert.Equal(t,
+		`UPDATE "ht_user" SET credit = 0; DELETE FROM "ht_user_usage"`,
+		withTables(`UPDATE {user} SET credit = 0; DELETE FROM {user_usage}`),
+		"used the prefixed table names",
+	)
+}
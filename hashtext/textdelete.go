@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// textDeleteBatchSize is how many texts adminTextDeleteHandler deletes in
+// each transaction, for the same reason the pruner works in batches.
+var textDeleteBatchSize = 1000
+
+// textDeleteFilter says which texts POST /admin/text/delete deletes. Every
+// field that's set must match. With no fields set it would delete every text,
+// so that also needs Confirm.
+type textDeleteFilter struct {
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	CreatedBy     *string    `json:"created_by,omitempty"`
+	Confirm       bool       `json:"confirm,omitempty"`
+}
+
+type textDeleteDocument struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// adminTextDeleteHandler deletes the texts matching a filter, in batches. Each
+// batch is committed along with its own audit log entry, so if we stop part
+// way through, the texts deleted so far stay deleted and are accounted for.
+func adminTextDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	// A misspelled field would otherwise be ignored, and widen the delete.
+	var f textDeleteFilter
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		sendErrorMessage(w, "The request body must be a JSON object with only created_before, created_by, and confirm", http.StatusBadRequest)
+		return
+	}
+	if f.CreatedBefore == nil && f.CreatedBy == nil && !f.Confirm {
+		sendErrorMessage(w, "Set created_before or created_by, or set confirm to true to delete every text", http.StatusBadRequest)
+		return
+	}
+
+	var before sql.NullTime
+	if f.CreatedBefore != nil {
+		before = sql.NullTime{Time: *f.CreatedBefore, Valid: true}
+	}
+	var by sql.NullString
+	if f.CreatedBy != nil {
+		by = sql.NullString{String: *f.CreatedBy, Valid: true}
+	}
+
+	var total int64
+	for {
+		var n int64
+		err := withTx(r.Context(), func(tx *sql.Tx) error {
+			// The deleted texts no longer count against the stored bytes
+			// of the users who stored them, as with the pruner.
+			err := tx.QueryRowContext(
+				r.Context(),
+				withTables(`WITH deleted AS (
+				     DELETE FROM {hash_text}
+				      WHERE hash IN (
+				          SELECT hash FROM {hash_text}
+				           WHERE ($1::timestamptz IS NULL OR created_at < $1)
+				             AND ($2::char(64) IS NULL OR created_by = $2)
+				           LIMIT $3
+				      )
+				     RETURNING created_by, octet_length(text) AS bytes
+				 ), freed AS (
+				     UPDATE {user} SET stored_bytes = stored_bytes - f.bytes
+				       FROM (SELECT created_by, SUM(bytes) AS bytes FROM deleted GROUP BY created_by) f
+				      WHERE user_id = f.created_by
+				 )
+				 SELECT COUNT(*) FROM deleted`),
+				before, by, textDeleteBatchSize,
+			).Scan(&n)
+			dbBreaker.recordContext(r.Context(), err)
+			if err != nil {
+				return err
+			}
+			return recordAdminAction(r.Context(), tx, r, "text.delete", map[string]interface{}{
+				"filter":  f,
+				"deleted": n,
+			})
+		})
+		if err != nil {
+			log.Printf("Failed to delete texts for admin %s after deleting %d: %v", requestUserID(r), total, err)
+			sendStatus(w, http.StatusInternalServerError)
+			return
+		}
+		total += n
+		if n < int64(textDeleteBatchSize) {
+			break
+		}
+		log.Printf("Admin %s has deleted %d texts so far", requestUserID(r), total)
+	}
+
+	log.Printf("Admin %s deleted %d texts", requestUserID(r), total)
+	sendJSONResponse(w, textDeleteDocument{Deleted: total})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminTextDeleteHandler(t *testing.T) {
+	adminID := sha256String("Jane")
+	adminUserIDs = map[string]bool{adminID: true}
+	defer func() { adminUserIDs = map[string]bool{} }()
+	saved := textDeleteBatchSize
+	textDeleteBatchSize = 2
+	defer func() { textDeleteBatchSize = saved }()
+	router := makeRouter()
+
+	userID := sha256String("Wendy")
+	execWithCheck(db, `INSERT INTO "user" (user_id, name, credit) VALUES ($1, 'Wendy', 0)`, userID)
+	var hashes []string
+	for i := 0; i < 5; i++ {
+		text := fmt.Sprintf("test admin text delete handler %d", i)
+		_, err := storeText(context.Background(), db, text, hashText(text), userID, 0)
+		assert.Nil(t, err, "no error storing text")
+		hashes = append(hashes, hashText(text))
+	}
+	// Only the first three are old enough to match created_before.
+	execWithCheck(db, `UPDATE hash_text SET created_at = '2001-01-01T00:00:00Z' WHERE hash = ANY($1)`, "{"+hashes[0]+","+hashes[1]+","+hashes[2]+"}")
+
+	del := func(body, asUser string) (*http.Response, textDeleteDocument) {
+		req := httptest.NewRequest("POST", "http://example.com/admin/text/delete", bytes.NewBufferString(body))
+		req.Header.Set("X-HashText-User-ID", asUser)
+		resp, respBody := fakeRequest(req, router.ServeHTTP)
+		var dd textDeleteDocument
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(respBody, &dd), "no error unmarshalling response body")
+		}
+		return resp, dd
+	}
+	remaining := func() int {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM hash_text WHERE created_by = $1`, userID).Scan(&n)
+		assert.Nil(t, err, "no error counting texts")
+		return n
+	}
+
+	resp, _ := del(`{}`, adminID)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a delete without a filter")
+	resp, _ = del(`{"created_befor":"2002-01-01T00:00:00Z"}`, adminID)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "returned 400 for a misspelled filter")
+	resp, _ = del(`{"created_by":"`+userID+`"}`, userID)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "returned 403 for a user who isn't an admin")
+	assert.Equal(t, 5, remaining(), "nothing was deleted")
+
+	resp, dd := del(`{"created_before":"2002-01-01T00:00:00Z","created_by":"`+userID+`"}`, adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 deleting old texts")
+	assert.Equal(t, textDeleteDocument{Deleted: 3}, dd, "deleted the old texts across two batches")
+	assert.Equal(t, 2, remaining(), "the newer texts are still stored")
+
+	var audited int
+	err := db.QueryRow(`SELECT COUNT(*) FROM admin_audit WHERE action = 'text.delete' AND admin_id = $1`, adminID).Scan(&audited)
+	assert.Nil(t, err, "no error counting audit entries")
+	assert.Equal(t, 2, audited, "recorded each batch in the audit log")
+
+	resp, dd = del(`{"created_by":"`+userID+`"}`, adminID)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 deleting by user")
+	assert.Equal(t, textDeleteDocument{Deleted: 2}, dd, "deleted the rest of the user's texts")
+	assert.Equal(t, 0, remaining(), "no texts are left")
+
+	var stored int64
+	err = db.QueryRow(`SELECT stored_bytes FROM "user" WHERE user_id = $1`, userID).Scan(&stored)
+	assert.Nil(t, err, "no error looking up stored bytes")
+	assert.Equal(t, int64(0), stored, "the deleted texts no longer count against the user")
+}
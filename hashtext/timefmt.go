@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A jsonTime is a time.Time that's sent to clients in the configured format
+// and time zone. Without it they'd get whatever zone the database driver gave
+// us, with however many fractional digits the time happened to have.
+type jsonTime struct {
+	time.Time
+}
+
+// timeFormats are the layouts HASHTEXT_TIME_FORMAT can choose from. They're
+// all RFC 3339, with different precision.
+var timeFormats = map[string]string{
+	"rfc3339":      time.RFC3339,
+	"rfc3339milli": "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339nano":  time.RFC3339Nano,
+}
+
+var (
+	// timeLayout is how times are written in responses.
+	timeLayout = time.RFC3339
+	// timeLocation is the time zone times are written in.
+	timeLocation = time.UTC
+)
+
+func parseTimeFormat(name string) (string, error) {
+	layout, ok := timeFormats[name]
+	if !ok {
+		var names []string
+		for n := range timeFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown time format %q, expected one of %v", name, names)
+	}
+	return layout, nil
+}
+
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.In(timeLocation).Format(timeLayout))
+}
+
+// Scan reads a TIMESTAMPTZ column.
+func (t *jsonTime) Scan(src interface{}) error {
+	v, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into a time", src)
+	}
+	t.Time = v
+	return nil
+}
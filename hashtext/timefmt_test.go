@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONTime(t *testing.T) {
+	defer func(layout string, loc *time.Location) { timeLayout, timeLocation = layout, loc }(timeLayout, timeLocation)
+
+	// The database hands us times in the session's zone, with microseconds.
+	created := time.Date(2017, 5, 1, 8, 3, 4, 123456000, time.FixedZone("PDT", -7*60*60))
+	respond := func() string {
+		rec := httptest.NewRecorder()
+		sendJSONResponse(rec, userHashDocument{Hash: "abc", CreatedAt: jsonTime{created}})
+		return rec.Body.String()
+	}
+
+	assert.Equal(t, `{"hash":"abc","created_at":"2017-05-01T15:03:04Z"}`, respond(), "sent an RFC 3339 UTC time by default")
+
+	layout, err := parseTimeFormat("rfc3339milli")
+	assert.Nil(t, err, "no error parsing rfc3339milli")
+	timeLayout = layout
+	assert.Equal(t, `{"hash":"abc","created_at":"2017-05-01T15:03:04.123Z"}`, respond(), "sent milliseconds with rfc3339milli")
+
+	timeLocation = time.FixedZone("", 2*60*60)
+	assert.Equal(t, `{"hash":"abc","created_at":"2017-05-01T17:03:04.123+02:00"}`, respond(), "sent the time in the configured zone")
+
+	_, err = parseTimeFormat("kitchen")
+	assert.NotNil(t, err, "error parsing an unknown format")
+
+	var jt jsonTime
+	assert.Nil(t, jt.Scan(created), "no error scanning a time")
+	assert.True(t, created.Equal(jt.Time), "scanned the time")
+	assert.NotNil(t, jt.Scan("yesterday"), "error scanning something else")
+
+	rec := httptest.NewRecorder()
+	sendJSONResponse(rec, textMetaDocument{Hash: "abc", CreatedAt: jsonTime{created}})
+	assert.Equal(t, http.StatusOK, rec.Code, "sent the metadata")
+	assert.Contains(t, rec.Body.String(), `"last_accessed_at":null`, "a missing time is still null")
+}
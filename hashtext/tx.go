@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// withTx runs fn in a transaction on the primary. The transaction is committed
+// if fn returns nil, and rolled back if fn returns an error or panics. A panic
+// is passed on once the transaction has been rolled back. If ctx is cancelled
+// before we commit, database/sql rolls the transaction back for us.
+func withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	dbBreaker.recordContext(ctx, err)
+	if err != nil {
+		log.Printf("Failed to begin a transaction: %v", err)
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	dbBreaker.recordContext(ctx, err)
+	if err != nil {
+		log.Printf("Failed to commit a transaction: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTx(t *testing.T) {
+	userID := sha256String("Jane")
+	insert := func(tx *sql.Tx, hash string) error {
+		_, err := tx.Exec(`INSERT INTO submission (user_id, hash) VALUES ($1, $2)`, userID, hash)
+		return err
+	}
+	count := func(hash string) int {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM submission WHERE hash = $1`, hash).Scan(&n)
+		assert.Nil(t, err, "no error counting submissions")
+		return n
+	}
+
+	committed := sha256String("test with tx committed")
+	err := withTx(context.Background(), func(tx *sql.Tx) error {
+		return insert(tx, committed)
+	})
+	assert.Nil(t, err, "no error from a transaction that succeeded")
+	assert.Equal(t, 1, count(committed), "the transaction was committed")
+
+	failed := sha256String("test with tx failed")
+	fnErr := errors.New("something went wrong")
+	err = withTx(context.Background(), func(tx *sql.Tx) error {
+		assert.Nil(t, insert(tx, failed), "no error inserting in the transaction")
+		return fnErr
+	})
+	assert.Equal(t, fnErr, err, "got the callback's error")
+	assert.Equal(t, 0, count(failed), "the transaction was rolled back")
+
+	panicked := sha256String("test with tx panicked")
+	assert.PanicsWithValue(t, "boom", func() {
+		withTx(context.Background(), func(tx *sql.Tx) error {
+			assert.Nil(t, insert(tx, panicked), "no error inserting in the transaction")
+			panic("boom")
+		})
+	}, "the panic was passed on")
+	assert.Equal(t, 0, count(panicked), "the transaction was rolled back after the panic")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// usageUpdates lets tests wait for recordUsage to finish.
+var usageUpdates sync.WaitGroup
+
+// recordUsage adds to the bytes a user has sent us and been sent, for cost
+// allocation. Like touchText it runs in the background, so that billing never
+// slows down or fails a request. It does nothing unless flags.TrackUsage is
+// set, since it's an extra write for every text stored or read.
+func recordUsage(userID string, ingested, served int64) {
+	if !flags.TrackUsage || userID == "" {
+		return
+	}
+	usageUpdates.Add(1)
+	go func() {
+		defer usageUpdates.Done()
+		_, err := db.Exec(
+			withTables(`INSERT INTO {user_usage} (user_id, bytes_ingested, bytes_served) VALUES ($1, $2, $3)
+			 ON CONFLICT (user_id) DO UPDATE
+			    SET bytes_ingested = {user_usage}.bytes_ingested + EXCLUDED.bytes_ingested,
+			        bytes_served = {user_usage}.bytes_served + EXCLUDED.bytes_served`),
+			userID, ingested, served,
+		)
+		dbBreaker.record(err)
+		if err != nil {
+			log.Printf("Failed to record usage for user_id = %s: %v", userID, err)
+		}
+	}()
+}
+
+// usageDocument is what GET /user/me/summary returns. StoredBytes is the size
+// of the texts the user stored first, which is what the byte quota counts.
+type usageDocument struct {
+	UserID        string `json:"user_id"`
+	BytesIngested int64  `json:"bytes_ingested"`
+	BytesServed   int64  `json:"bytes_served"`
+	StoredBytes   int64  `json:"stored_bytes"`
+}
+
+func userSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	ud := usageDocument{UserID: requestUserID(r)}
+	err := withReadFallback(func(q *sql.DB) error {
+		return q.QueryRow(
+			withTables(`SELECT COALESCE(uu.bytes_ingested, 0), COALESCE(uu.bytes_served, 0), u.stored_bytes
+			   FROM {user} u
+			   LEFT JOIN {user_usage} uu USING (user_id)
+			  WHERE u.user_id = $1`),
+			ud.UserID,
+		).Scan(&ud.BytesIngested, &ud.BytesServed, &ud.StoredBytes)
+	})
+	dbBreaker.record(err)
+	switch {
+	case err == sql.ErrNoRows:
+		sendStatus(w, http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Query to look up usage failed: %v", err)
+		sendStatus(w, http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, ud)
+}
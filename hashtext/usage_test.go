@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserSummaryHandler(t *testing.T) {
+	userID := sha256String("Xiomara")
+	summary := func() usageDocument {
+		usageUpdates.Wait()
+		req := httptest.NewRequest("GET", "http://example.com/user/me/summary", nil)
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, body := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for the usage summary")
+		var ud usageDocument
+		err := json.Unmarshal(body, &ud)
+		assert.Nil(t, err, "no error unmarshalling response body")
+		return ud
+	}
+	post := func(text string) {
+		req := httptest.NewRequest("POST", "http://example.com/text", bytes.NewBufferString(text))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-HashText-User-ID", userID)
+		resp, _ := fakeRequest(req, wrapHandler(textHandler))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for posting text")
+	}
+
+	before := summary()
+	assert.Equal(t, userID, before.UserID, "got the user's summary")
+
+	text := "test user summary handler untracked"
+	post(text)
+	assert.Equal(t, before.BytesIngested, summary().BytesIngested, "usage isn't tracked without the flag")
+
+	flags.TrackUsage = true
+	defer func() { flags.TrackUsage = false }()
+
+	text = "test user summary handler"
+	post(text)
+	post(text)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("http://example.com/text/%s", hashText(text)), nil)
+	req.Header.Set("X-HashText-User-ID", userID)
+	resp, _ := fakeRequest(req, func(w http.ResponseWriter, r *http.Request) { makeRouter().ServeHTTP(w, r) })
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "returned 200 for reading text")
+
+	after := summary()
+	assert.Equal(t, before.BytesIngested+int64(2*len(text)), after.BytesIngested, "counted both submissions as ingested")
+	assert.Equal(t, before.BytesServed+int64(len(text)), after.BytesServed, "counted the read as served")
+}
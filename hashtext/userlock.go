@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// userLocks hands out one mutex per user_id so that concurrent requests from
+// the same user queue up in the app instead of piling up on a row lock in
+// Postgres. A user's entry is removed as soon as nobody holds or is waiting
+// for it, so the map only ever contains users with requests in flight.
+//
+// A nil *userLocks is valid and does nothing, which is how the feature is
+// turned off.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newUserLocks() *userLocks {
+	return &userLocks{locks: map[string]*userLock{}}
+}
+
+func (ul *userLocks) lock(userID string) {
+	if ul == nil {
+		return
+	}
+
+	ul.mu.Lock()
+	l, ok := ul.locks[userID]
+	if !ok {
+		l = &userLock{}
+		ul.locks[userID] = l
+	}
+	l.refs++
+	ul.mu.Unlock()
+
+	l.Lock()
+}
+
+func (ul *userLocks) unlock(userID string) {
+	if ul == nil {
+		return
+	}
+
+	ul.mu.Lock()
+	l := ul.locks[userID]
+	l.refs--
+	if l.refs == 0 {
+		delete(ul.locks, userID)
+	}
+	ul.mu.Unlock()
+
+	l.Unlock()
+}
+
+func (ul *userLocks) size() int {
+	if ul == nil {
+		return 0
+	}
+
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+	return len(ul.locks)
+}
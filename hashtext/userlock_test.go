@@ -0,0 +1,44 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserLocks(t *testing.T) {
+	ul := newUserLocks()
+
+	var wg sync.WaitGroup
+	inFlight := map[string]*int32{"jane": new(int32), "xiomara": new(int32)}
+	var overlapped int32
+	for i := 0; i < 100; i++ {
+		for userID := range inFlight {
+			wg.Add(1)
+			go func(userID string) {
+				defer wg.Done()
+				ul.lock(userID)
+				defer ul.unlock(userID)
+
+				if atomic.AddInt32(inFlight[userID], 1) > 1 {
+					atomic.AddInt32(&overlapped, 1)
+				}
+				runtime.Gosched()
+				atomic.AddInt32(inFlight[userID], -1)
+			}(userID)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(0), overlapped, "only one goroutine per user held the lock at a time")
+	assert.Equal(t, 0, ul.size(), "locks are evicted once nobody holds them")
+
+	var disabled *userLocks
+	disabled.lock("jane")
+	disabled.lock("jane")
+	disabled.unlock("jane")
+	assert.Equal(t, 0, disabled.size(), "a nil userLocks is a no-op")
+}
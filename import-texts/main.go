@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+	_ "github.com/lib/pq"
+)
+
+// tables replaces the table placeholders in our queries, like the server's
+// withTables does.
+var tables *strings.Replacer
+
+type counts struct {
+	inserted, present, collisions int
+}
+
+// Bulk loads a file of newline-separated texts, one text per line, as if the
+// user had submitted each of them. Blank lines are skipped. Each batch is
+// stored in its own transaction, so if we stop part way through, everything
+// in the earlier batches stays imported.
+func main() {
+	var dbName, userID, encoding, prefix, price, searchPath string
+	var noCharge bool
+	var batchSize, maxTextBytes int
+	flag.StringVar(&dbName, "db", "hashtext", "the name of the database to import into")
+	flag.StringVar(&userID, "user", "", "the user_id to attribute the texts to")
+	flag.BoolVar(&noCharge, "no-charge", false, "don't debit the user's credit for the texts")
+	flag.IntVar(&batchSize, "batch-size", 500, "how many texts to store in each transaction")
+	flag.IntVar(&maxTextBytes, "max-text-bytes", 1<<20, "the longest line to accept, in bytes")
+	flag.StringVar(&encoding, "digest-encoding", "hex", "how to write hashes, which must match the server's HASHTEXT_DIGEST_ENCODING")
+	flag.StringVar(&prefix, "table-prefix", "", "the server's HASHTEXT_TABLE_PREFIX, if it sets one")
+	flag.StringVar(&searchPath, "search-path", "public", "the server's HASHTEXT_SEARCH_PATH, if it sets one")
+	flag.StringVar(&price, "text-price", "1", "what each new text costs, which must match the server's HASHTEXT_TEXT_PRICE")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -user <user_id> [flags] <file>\n\nUse - as the file to read from stdin.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// These are the encodings the server accepts in HASHTEXT_DIGEST_ENCODING,
+	// so that it finds what we import.
+	de, ok := hashstore.DigestEncodings[encoding]
+	if userID == "" || flag.NArg() != 1 || batchSize < 1 || !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	names, err := hashstore.NewTableNames(prefix)
+	if err != nil {
+		fmt.Println("** Invalid -table-prefix: " + err.Error())
+		os.Exit(1)
+	}
+	tables = names.Replacer()
+
+	if err := hashstore.CheckSchemaName(searchPath); err != nil {
+		fmt.Println("** Invalid -search-path: " + err.Error())
+		os.Exit(1)
+	}
+
+	if !regexp.MustCompile(`^[0-9]+(\.[0-9]{1,2})?$`).MatchString(price) {
+		fmt.Println("** The text price must be a number with at most two decimal places")
+		os.Exit(1)
+	}
+
+	in := os.Stdin
+	if name := flag.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Println("** Could not open " + name + ": " + err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	db := connectToDB(dbName, searchPath)
+	defer db.Close()
+
+	var exists bool
+	err = db.QueryRow(tables.Replace(`SELECT true FROM {user} WHERE user_id = $1`), userID).Scan(&exists)
+	if err != nil {
+		fmt.Println("** Could not find the user with user_id = " + userID + ": " + err.Error())
+		os.Exit(1)
+	}
+
+	total, err := importTexts(db, in, userID, !noCharge, price, batchSize, maxTextBytes, de.Encode)
+	fmt.Printf("Inserted %d texts, %d were already present", total.inserted, total.present)
+	if total.collisions > 0 {
+		fmt.Printf(", and skipped %d whose hash is already used by a different text", total.collisions)
+	}
+	fmt.Print("\n")
+	if err != nil {
+		fmt.Println("** " + err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func importTexts(db *sql.DB, in io.Reader, userID string, charge bool, price string, batchSize, maxTextBytes int, encode func([]byte) string) (counts, error) {
+	var total counts
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxTextBytes+1)
+
+	var batch []string
+	flush := func() error {
+		c, err := storeBatch(db, batch, userID, charge, price, encode)
+		if err != nil {
+			return err
+		}
+		total.inserted += c.inserted
+		total.present += c.present
+		total.collisions += c.collisions
+		batch = batch[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		batch = append(batch, text)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, fmt.Errorf("could not read the texts: %v", err)
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// storeBatch stores the texts with hashstore.StoreText, like the server does,
+// and then debits the user price for each text that was new. If the user
+// can't pay for the whole batch, none of it is stored. Postgres does the
+// arithmetic on the price, so it's exact whether credit is a BIGINT or a
+// NUMERIC.
+func storeBatch(db *sql.DB, texts []string, userID string, charge bool, price string, encode func([]byte) string) (counts, error) {
+	var c counts
+	tx, err := db.Begin()
+	if err != nil {
+		return counts{}, fmt.Errorf("could not begin a transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, text := range texts {
+		sum := sha256.Sum256([]byte(text))
+		novel, err := hashstore.StoreText(context.Background(), tx, tables, text, encode(sum[:]), userID, 0)
+		switch {
+		case err == hashstore.ErrHashCollision:
+			c.collisions++
+		case err != nil:
+			return counts{}, err
+		case novel:
+			c.inserted++
+		default:
+			c.present++
+		}
+	}
+
+	if charge && c.inserted > 0 {
+		res, err := tx.Exec(
+			tables.Replace(`UPDATE {user} SET credit = credit - $2::numeric * $3, version = version + 1 WHERE user_id = $1 AND credit >= $2::numeric * $3`),
+			userID, price, c.inserted,
+		)
+		if err != nil {
+			return counts{}, fmt.Errorf("could not debit the user: %v", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return counts{}, fmt.Errorf("the user can't pay for the %d new texts in this batch, so it wasn't imported", c.inserted)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return counts{}, fmt.Errorf("could not commit the batch: %v", err)
+	}
+	return c, nil
+}
+
+func connectToDB(name, schema string) *sql.DB {
+	dsn := fmt.Sprintf("user=hashtext password=hashtext dbname=%s host=127.0.0.1 application_name=hashtext-import-texts", name)
+	if schema != "public" {
+		dsn += " search_path=" + schema
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		fmt.Println("** Error connecting to the " + name + " database as user hashtext: " + err.Error())
+		os.Exit(1)
+	}
+
+	return db
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// These tests use the database the server's tests use, and clean up the
+// users and texts they make.
+func testDB() *sql.DB {
+	names, _ := hashstore.NewTableNames("")
+	tables = names.Replacer()
+	return connectToDB("hashtext_test", "public")
+}
+
+// testUser makes a user with the given credit. The texts it imports get a
+// suffix unique to the run, so that running the tests again stores them anew.
+func testUser(t *testing.T, db *sql.DB, name string, credit int64) (userID, suffix string) {
+	suffix = fmt.Sprintf(" %d", time.Now().UnixNano())
+	sum := sha256.Sum256([]byte(name + suffix))
+	userID = hex.EncodeToString(sum[:])
+	_, err := db.Exec(`INSERT INTO "user" (user_id, name, credit) VALUES ($1, $2, $3)`, userID, name, credit)
+	assert.Nil(t, err, "no error creating %s", name)
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM submission WHERE user_id = $1`, userID)
+		db.Exec(`DELETE FROM hash_text WHERE created_by = $1`, userID)
+		db.Exec(`DELETE FROM "user" WHERE user_id = $1`, userID)
+	})
+	return userID, suffix
+}
+
+func hexHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestImportTexts(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	userID, suffix := testUser(t, db, "Imogen", 10)
+
+	// A different text already stored under the hash of "c" looks like a
+	// collision to the import.
+	_, err := db.Exec(`INSERT INTO hash_text (hash, text, created_by) VALUES ($1, $2, $3)`, hexHash("c"+suffix), "not c", userID)
+	assert.Nil(t, err, "no error storing the colliding text")
+
+	in := strings.NewReader("a" + suffix + "\n\nb" + suffix + "\n  \na" + suffix + "\nc" + suffix + "\n")
+	c, err := importTexts(db, in, userID, true, "1", 2, 1024, hex.EncodeToString)
+	assert.Nil(t, err, "no error importing")
+	assert.Equal(t, counts{inserted: 2, present: 1, collisions: 1}, c, "counted new, present, and colliding texts")
+
+	var credit int64
+	var submissions int
+	err = db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID).Scan(&credit)
+	assert.Nil(t, err, "no error getting credit")
+	assert.Equal(t, int64(8), credit, "charged only for the new texts")
+	err = db.QueryRow(`SELECT COUNT(*) FROM submission WHERE user_id = $1`, userID).Scan(&submissions)
+	assert.Nil(t, err, "no error counting submissions")
+	assert.Equal(t, 3, submissions, "recorded a submission for each text except the collision")
+}
+
+func TestImportTextsChargesWholeBatches(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	userID, suffix := testUser(t, db, "Bartholomew", 3)
+
+	in := strings.NewReader("p" + suffix + "\nq" + suffix + "\nr" + suffix + "\ns" + suffix + "\n")
+	c, err := importTexts(db, in, userID, true, "1", 2, 1024, hex.EncodeToString)
+	assert.NotNil(t, err, "error when the user can't pay for the second batch")
+	assert.Equal(t, counts{inserted: 2}, c, "counted only the first batch")
+
+	var credit int64
+	err = db.QueryRow(`SELECT credit FROM "user" WHERE user_id = $1`, userID).Scan(&credit)
+	assert.Nil(t, err, "no error getting credit")
+	assert.Equal(t, int64(1), credit, "charged only for the first batch")
+
+	for _, text := range []string{"r", "s"} {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM hash_text WHERE hash = $1)`, hexHash(text+suffix)).Scan(&exists)
+		assert.Nil(t, err, "no error looking up %s", text)
+		assert.False(t, exists, "%s from the unpaid batch wasn't stored", text)
+	}
+}
@@ -1,24 +1,60 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
+	"github.com/ActiveState/golang-gorilla-webapp/hashstore"
 	_ "github.com/lib/pq"
 )
 
+var applicationName string
+
+// tablePrefix is prepended to the name of every table and index, to match
+// the server's HASHTEXT_TABLE_PREFIX.
+var tablePrefix string
+
+// moneyCredit makes the credit columns NUMERIC, for a server run with
+// HASHTEXT_MONEY_CREDIT.
+var moneyCredit bool
+
+// searchPath is the schema to create the tables in, matching the server's
+// HASHTEXT_SEARCH_PATH.
+var searchPath string
+
+// statementTimeout is how long we wait for each statement before giving up,
+// so that an unresponsive Postgres can't hang a CI run forever.
+var statementTimeout time.Duration
+
 // This isn't very elegant but it gets the job done. If this were a real app
 // we'd use something like Sqitch (http://sqitch.org/) to manage the schema,
 // but for the purposes of our demo app we only want to require ActiveGo.
 func main() {
 	var dbName string
 	flag.StringVar(&dbName, "db", "hashtext", "the name of the database to create")
+	flag.StringVar(&applicationName, "application-name", "hashtext-make-schema", "the application_name to report to Postgres")
+	flag.DurationVar(&statementTimeout, "statement-timeout", time.Minute, "how long to wait for each SQL statement to finish")
+	flag.StringVar(&tablePrefix, "table-prefix", "", "a prefix for every table name, matching the server's HASHTEXT_TABLE_PREFIX")
+	flag.StringVar(&searchPath, "search-path", "public", "the schema to create the tables in, matching the server's HASHTEXT_SEARCH_PATH")
+	flag.BoolVar(&moneyCredit, "money", false, "store credit as money with two decimal places, for HASHTEXT_MONEY_CREDIT")
 	flag.Parse()
 
+	if _, err := hashstore.NewTableNames(tablePrefix); err != nil {
+		fmt.Println("** Invalid -table-prefix: " + err.Error())
+		os.Exit(1)
+	}
+	if err := hashstore.CheckSchemaName(searchPath); err != nil {
+		fmt.Println("** Invalid -search-path: " + err.Error())
+		os.Exit(1)
+	}
+
 	fmt.Printf("(Re-)Building the %s database\n", dbName)
 	fmt.Println("  This script connects as a user named 'hashtext' with the password 'hashtext'")
 	fmt.Println("  to the host 127.0.0.1")
@@ -33,7 +69,7 @@ func main() {
 }
 
 func createDB(dbName string) {
-	db := connectToDB("template1")
+	db := connectToDB("template1", "public")
 
 	execWithCheck(db, fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
 	execWithCheck(db, fmt.Sprintf("CREATE DATABASE %s ENCODING=UTF8", dbName))
@@ -46,7 +82,12 @@ func createDB(dbName string) {
 }
 
 func runDDL(dbName string) {
-	db := connectToDB(dbName)
+	if searchPath != "public" {
+		db := connectToDB(dbName, "public")
+		execWithCheck(db, fmt.Sprintf("CREATE SCHEMA %s", searchPath))
+		db.Close()
+	}
+	db := connectToDB(dbName, searchPath)
 
 	ddl, err := ioutil.ReadFile("../schema.sql")
 	if err != nil {
@@ -54,13 +95,50 @@ func runDDL(dbName string) {
 		os.Exit(1)
 	}
 
-	for _, s := range regexp.MustCompile("(?s:(.+?));\\n*").FindAllStringSubmatch(string(ddl), -1) {
+	for _, s := range regexp.MustCompile("(?s:(.+?));\\n*").FindAllStringSubmatch(prefixTables(moneyColumns(string(ddl))), -1) {
 		execWithCheck(db, s[1])
 	}
 }
 
-func connectToDB(name string) *sql.DB {
-	db, err := sql.Open("postgres", fmt.Sprintf("user=hashtext password=hashtext dbname=%s host=127.0.0.1", name))
+// prefixTables adds tablePrefix to the table and index names in the DDL. The
+// table names come from hashstore, so a new table is prefixed here as soon
+// as the server knows about it.
+func prefixTables(ddl string) string {
+	if tablePrefix == "" {
+		return ddl
+	}
+	names, _ := hashstore.NewTableNames("")
+	ddl = strings.ReplaceAll(ddl, `"`+names.User+`"`, `"`+tablePrefix+names.User+`"`)
+	var unquoted []string
+	for _, n := range names.Names() {
+		if n != names.User {
+			unquoted = append(unquoted, regexp.QuoteMeta(n))
+		}
+	}
+	ddl = regexp.MustCompile(`([^.\w])(`+strings.Join(unquoted, "|")+`)\b`).ReplaceAllString(ddl, "${1}"+tablePrefix+"$2")
+	return regexp.MustCompile(`CREATE INDEX (\w+)`).ReplaceAllString(ddl, "CREATE INDEX "+tablePrefix+"$1")
+}
+
+// moneyColumns makes the credit columns in the DDL NUMERIC when moneyCredit
+// is set.
+func moneyColumns(ddl string) string {
+	if !moneyCredit {
+		return ddl
+	}
+	return regexp.MustCompile(`(?m)^(\s+(?:credit|amount)\s+)BIGINT\b`).ReplaceAllString(ddl, "${1}NUMERIC(20,2)")
+}
+
+// connectToDB connects to the named database. Tables are created in schema,
+// which is set the same way the server sets HASHTEXT_SEARCH_PATH.
+func connectToDB(name, schema string) *sql.DB {
+	dsn := fmt.Sprintf(
+		"user=hashtext password=hashtext dbname=%s host=127.0.0.1 application_name=%s",
+		name, quoteDSNValue(applicationName),
+	)
+	if schema != "public" {
+		dsn += " search_path=" + quoteDSNValue(schema)
+	}
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		fmt.Println("** Error connecting to the " + name + " database as user hashtext: " + err.Error())
 		os.Exit(1)
@@ -69,10 +147,22 @@ func connectToDB(name string) *sql.DB {
 	return db
 }
 
+func quoteDSNValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
 func execWithCheck(db *sql.DB, s string, args ...interface{}) {
 	fmt.Println(s)
 	fmt.Println("----")
-	_, err := db.Exec(s, args...)
+	ctx, cancel := context.WithTimeout(context.Background(), statementTimeout)
+	defer cancel()
+	_, err := db.ExecContext(ctx, s, args...)
+	// lib/pq reports a cancelled query as a server error, so we check the
+	// context rather than err to see whether we timed out.
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		fmt.Println("** Timed out after " + statementTimeout.String() + " executing SQL: " + s)
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Println("** Error executing SQL - " + err.Error() + ": " + s)
 		os.Exit(1)
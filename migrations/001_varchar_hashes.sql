@@ -0,0 +1,7 @@
+-- Text hashes used to be CHAR(64), which blank-pads the shorter base64url and
+-- base32 hashes, so they were sent back to clients with trailing spaces.
+-- Run this once against a database made by an older make-schema. With
+-- -table-prefix, add the prefix to the table names first.
+-- A database old enough not to have the submission table gets it from 002.
+ALTER TABLE hash_text ALTER COLUMN hash TYPE VARCHAR(64) USING rtrim(hash);
+ALTER TABLE IF EXISTS submission ALTER COLUMN hash TYPE VARCHAR(64) USING rtrim(hash);
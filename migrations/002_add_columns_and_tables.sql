@@ -0,0 +1,68 @@
+-- Adds the columns and tables that schema.sql has gained since the first
+-- release, to a database made by an older make-schema. Run it after 001. It
+-- only adds what's missing, so it's safe to run against a database that
+-- already has some of them. With -table-prefix, add the prefix to the table
+-- and index names first. With -money, make credit_hold.amount NUMERIC(20,2).
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS stored_bytes BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS entitlements JSONB NOT NULL DEFAULT '{}';
+
+-- Texts stored before these columns existed get the time of the migration
+-- as their created_at, and no created_by, as we can't know either.
+ALTER TABLE hash_text ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE hash_text ADD COLUMN IF NOT EXISTS last_accessed_at TIMESTAMPTZ;
+ALTER TABLE hash_text ADD COLUMN IF NOT EXISTS created_by CHAR(64) REFERENCES "user";
+
+CREATE INDEX IF NOT EXISTS hash_text_created_by_created_at ON hash_text (created_by, created_at);
+
+-- stored_bytes is kept up to date as texts are stored and deleted, so it has
+-- to start from what each user has already stored, or the byte quota would
+-- undercount it. Texts without a created_by don't count against anyone.
+UPDATE "user" u SET stored_bytes = s.bytes
+  FROM (SELECT created_by, SUM(octet_length(text)) AS bytes
+          FROM hash_text
+         WHERE created_by IS NOT NULL
+         GROUP BY created_by) s
+ WHERE u.user_id = s.created_by;
+
+CREATE TABLE IF NOT EXISTS user_usage (
+    user_id        CHAR(64)  PRIMARY KEY REFERENCES "user",
+    bytes_ingested BIGINT    NOT NULL DEFAULT 0,
+    bytes_served   BIGINT    NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS submission (
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    hash       VARCHAR(64)  NOT NULL,
+    duplicate  BOOLEAN      NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS submission_user_id_created_at ON submission (user_id, created_at);
+CREATE INDEX IF NOT EXISTS submission_created_at ON submission (created_at);
+
+CREATE TABLE IF NOT EXISTS api_key (
+    key_hash   CHAR(64)     PRIMARY KEY,
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS credit_hold (
+    hold_id    CHAR(64)     PRIMARY KEY,
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    amount     BIGINT       NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ  NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS admin_audit (
+    audit_id   BIGSERIAL    PRIMARY KEY,
+    admin_id   CHAR(64)     NOT NULL,
+    action     TEXT         NOT NULL,
+    detail     JSONB        NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+COMMIT;
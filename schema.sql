@@ -1,10 +1,63 @@
 CREATE TABLE "user" (
     user_id  CHAR(64)   PRIMARY KEY, -- a SHA256 token for web requests
     name     TEXT       NOT NULL,
-    credit   BIGINT     DEFAULT 0 -- credits in cents
+    credit   BIGINT     DEFAULT 0, -- NUMERIC(20,2) money with make-schema -money
+    version  BIGINT     NOT NULL DEFAULT 1, -- bumped by every update
+    stored_bytes BIGINT NOT NULL DEFAULT 0, -- the size of the texts this user stored first
+    entitlements JSONB  NOT NULL DEFAULT '{}' -- per-user overrides of the global limits
 );
 
 CREATE TABLE hash_text (
-    hash     CHAR(64)   PRIMARY KEY,
-    text     TEXT
+    hash             VARCHAR(64)  PRIMARY KEY, -- not CHAR, which would pad the shorter encodings
+    text             TEXT,
+    created_at       TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    last_accessed_at TIMESTAMPTZ,
+    created_by       CHAR(64)     REFERENCES "user" -- the user whose submission stored it
+);
+
+CREATE INDEX hash_text_created_by_created_at ON hash_text (created_by, created_at);
+
+-- How many bytes each user has sent and been sent, kept when
+-- HASHTEXT_TRACK_USAGE is set.
+CREATE TABLE user_usage (
+    user_id        CHAR(64)  PRIMARY KEY REFERENCES "user",
+    bytes_ingested BIGINT    NOT NULL DEFAULT 0, -- texts submitted, duplicates included
+    bytes_served   BIGINT    NOT NULL DEFAULT 0  -- texts read back by hash
+);
+
+-- Every text a user submits, whether or not it was already stored.
+CREATE TABLE submission (
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    hash       VARCHAR(64)  NOT NULL,
+    duplicate  BOOLEAN      NOT NULL DEFAULT false, -- the text was already stored
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+CREATE INDEX submission_user_id_created_at ON submission (user_id, created_at);
+CREATE INDEX submission_created_at ON submission (created_at);
+
+CREATE TABLE api_key (
+    key_hash   CHAR(64)     PRIMARY KEY, -- the SHA256 hash of the key
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+
+-- Credit set aside by POST /text/reserve. The credit is taken out of the
+-- user's balance while it's held.
+CREATE TABLE credit_hold (
+    hold_id    CHAR(64)     PRIMARY KEY, -- the SHA256 hash of the hold token
+    user_id    CHAR(64)     NOT NULL REFERENCES "user",
+    amount     BIGINT       NOT NULL, -- NUMERIC(20,2) like "user".credit with -money
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ  NOT NULL
+);
+
+-- Every change an admin makes through the /admin routes. admin_id isn't a
+-- foreign key, so that the record outlives the admin's user.
+CREATE TABLE admin_audit (
+    audit_id   BIGSERIAL    PRIMARY KEY,
+    admin_id   CHAR(64)     NOT NULL, -- the user_id of the admin who made the change
+    action     TEXT         NOT NULL, -- what they did, like user.entitlements.set
+    detail     JSONB        NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT now()
 );